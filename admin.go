@@ -0,0 +1,105 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// staleAfter is how long a property may go without a fresh value before it's
+// reported stale, matching how long fetch falls back to saved values.
+const staleAfter = 48 * time.Hour
+
+type StaleProperty struct {
+	Id            string    `json:"id"`
+	Name          string    `json:"name"`
+	Username      string    `json:"username"`
+	LastRefreshed time.Time `json:"lastRefreshed"`
+	Problems      []string  `json:"problems"`
+}
+
+// stale reports the properties whose badges are no longer being refreshed, or
+// whose account can't get a token anymore, so dead badges can be pruned. It
+// only reads what was saved, leaving token refreshes to /cron/tokens.
+func stale(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "application/json")
+	if !user.IsAdmin(c) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "admin only"})
+		return
+	}
+	var properties []Property
+	keys, err := datastore.NewQuery("Property").GetAll(c, &properties)
+	if err != nil {
+		c.Errorf("stale(Property) error: %#v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	// Each account is only looked up once, however many properties.
+	type owner struct {
+		Username string
+		Expired  time.Time
+		Problem  string
+	}
+	owners := make(map[string]owner)
+	report := []StaleProperty{}
+	for i, p := range properties {
+		s := StaleProperty{Id: keys[i].StringID(), Name: p.Name}
+		ak := p.Account.Encode()
+		o, ok := owners[ak]
+		if !ok {
+			var a Account
+			if err := datastore.Get(c, p.Account, &a); err != nil {
+				c.Errorf("stale(Account) error: %#v", err)
+				o.Problem = "account missing"
+			} else {
+				o.Username = a.Username
+				if a.GetToken() == nil {
+					o.Problem = "no token"
+				} else if a.Expiry.Before(time.Now()) {
+					o.Expired = a.Expiry
+				}
+				var check TokenCheck
+				if err := datastore.Get(c, tokenCheckKey(c, p.Account), &check); err == nil && check.Error != "" {
+					o.Problem = "token refresh failed: " + check.Error
+				}
+			}
+			owners[ak] = o
+		}
+		s.Username = o.Username
+		if o.Problem != "" {
+			s.Problems = append(s.Problems, o.Problem)
+		}
+		if p.Profile == "" {
+			s.Problems = append(s.Problems, "disabled")
+		}
+		var values []Value
+		if _, err := datastore.NewQuery("Value").Ancestor(keys[i]).GetAll(c, &values); err != nil {
+			c.Errorf("stale(Value) error: %#v", err)
+		}
+		for _, v := range values {
+			if v.CachedAt.After(s.LastRefreshed) {
+				s.LastRefreshed = v.CachedAt
+			}
+		}
+		if s.LastRefreshed.IsZero() {
+			s.Problems = append(s.Problems, "never refreshed")
+		} else if time.Since(s.LastRefreshed) > staleAfter {
+			s.Problems = append(s.Problems, "not refreshed since "+s.LastRefreshed.Format(time.RFC3339))
+			// Tokens are refreshed ahead of expiry, so one which ran out
+			// while the badge went stale has most likely been revoked.
+			if !o.Expired.IsZero() {
+				s.Problems = append(s.Problems, "token expired "+o.Expired.Format(time.RFC3339))
+			}
+		}
+		if len(s.Problems) > 0 {
+			report = append(report, s)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"checked": len(properties), "stale": report})
+}
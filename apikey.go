@@ -0,0 +1,200 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errAPIKey = errors.New("no account has this API key")
+
+// hashKey is how API keys are stored, so a leaked Account can't be used to
+// sign in. Keys are random, so a plain hash is enough.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// accountByKey finds the account an API key was minted for.
+func accountByKey(c appengine.Context, key string) (*Account, error) {
+	if key == "" {
+		return nil, errAPIKey
+	}
+	var accounts []Account
+	q := datastore.NewQuery("Account").Filter("APIKeyHash =", hashKey(key)).Limit(1)
+	if _, err := q.GetAll(c, &accounts); err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, errAPIKey
+	}
+	return &accounts[0], nil
+}
+
+// apiKey mints a new API key for the signed in account with POST, replacing
+// any previous one, or revokes it with DELETE. The key is only shown once.
+func apiKey(w http.ResponseWriter, r *http.Request, s *Session) error {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Account.Username == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "not signed in"})
+	}
+	switch r.Method {
+	case "POST":
+		key, err := randomId()
+		if err != nil {
+			return err
+		}
+		s.Account.APIKeyHash = hashKey(key)
+		return json.NewEncoder(w).Encode(map[string]string{"key": key})
+	case "DELETE":
+		s.Account.APIKeyHash = ""
+		return json.NewEncoder(w).Encode(map[string]bool{"revoked": true})
+	}
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return json.NewEncoder(w).Encode(map[string]string{"error": "POST or DELETE required"})
+}
+
+// PropertyRequest is the body of a POST to /api/properties, with the same
+// settings as the manage form.
+type PropertyRequest struct {
+	Id       string   `json:"id"`
+	Profile  string   `json:"profile"`
+	Profiles []string `json:"profiles"`
+	TTL      int      `json:"ttl"`
+	Limit    int      `json:"limit"`
+	Referers []string `json:"referers"`
+	Yellow   int      `json:"yellow"`
+	Green    int      `json:"green"`
+	Invert   bool     `json:"invert"`
+	Metric   string   `json:"metric"`
+	Range    string   `json:"range"`
+	Target   int      `json:"target"`
+}
+
+// property builds the Property a request describes, given the profiles and
+// names of the Analytics property it was checked against.
+func (req *PropertyRequest) property(account *datastore.Key, profiles map[string]bool, names [2]string) *Property {
+	p := &Property{
+		Account:         account,
+		Id:              req.Id,
+		Profile:         req.Profile,
+		Name:            names[0],
+		AccountName:     names[1],
+		CacheTTL:        time.Duration(req.TTL) * time.Minute,
+		HourlyLimit:     req.Limit,
+		AllowedReferers: referers(strings.Join(req.Referers, "\n")),
+	}
+	p.CacheTTL = p.ttl()
+	p.HourlyLimit = p.limit()
+	for _, allowed := range req.Profiles {
+		if profiles[allowed] {
+			p.Profiles = append(p.Profiles, allowed)
+		}
+	}
+	if t := (Thresholds{Yellow: req.Yellow, Green: req.Green, Invert: req.Invert}); t.valid() && t != defaultThresholds {
+		p.Thresholds = t
+	}
+	if metrics[req.Metric].Label != "" {
+		p.DefaultMetric = req.Metric
+	}
+	if ranges[req.Range].Start != "" {
+		p.DefaultRange = req.Range
+	}
+	if req.Target > 0 {
+		p.Target = req.Target
+	}
+	return p
+}
+
+// propertyRequest describes a saved Property the way it would be submitted,
+// for exporting.
+func propertyRequest(p *Property) PropertyRequest {
+	t := p.Thresholds
+	if t == (Thresholds{}) {
+		t = defaultThresholds
+	}
+	return PropertyRequest{
+		Id:       p.Id,
+		Profile:  p.Profile,
+		Profiles: p.Profiles,
+		TTL:      int(p.ttl() / time.Minute),
+		Limit:    p.limit(),
+		Referers: p.AllowedReferers,
+		Yellow:   t.Yellow,
+		Green:    t.Green,
+		Invert:   t.Invert,
+		Metric:   p.DefaultMetric,
+		Range:    p.DefaultRange,
+		Target:   p.Target,
+	}
+}
+
+// apiProperties saves a property's badge settings with POST, or removes them
+// with DELETE and an id parameter, like the manage form does. Badges are
+// listed by /api/badges.
+func apiProperties(w http.ResponseWriter, r *http.Request, s *Session) error {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Account.Username == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "not signed in"})
+	}
+	c := appengine.NewContext(r)
+	owned, err := ownedKeys(c, s.Key(c))
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case "DELETE":
+		k, ok := owned[r.FormValue("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return json.NewEncoder(w).Encode(map[string]string{"error": "no such property"})
+		}
+		if err := deleteProperties(c, []*datastore.Key{k}); err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(map[string]interface{}{"id": k.StringID(), "deleted": true})
+	case "POST":
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "POST or DELETE required"})
+	}
+	var req PropertyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON: " + err.Error()})
+	}
+	t := transport(c, &s.Account)
+	if t.Token == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "sign in again to grant Analytics access"})
+	}
+	_, loaded, names, err := visible(c, t)
+	if s.Account.TokenChanged(t.Token) {
+		s.Account.SetToken(t.Token)
+	}
+	if err != nil {
+		return err
+	}
+	if !loaded[req.Id][req.Profile] {
+		w.WriteHeader(http.StatusBadRequest)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "view not available to this account"})
+	}
+	p := req.property(s.Key(c), loaded[req.Id], names[req.Id])
+	k, ok := owned[req.Id]
+	if !ok {
+		k = propertyKey(c, s.Key(c), req.Id)
+	}
+	if _, err := datastore.Put(c, k, p); err != nil {
+		return err
+	}
+	invalidate(c, k.StringID())
+	return json.NewEncoder(w).Encode(map[string]string{"id": k.StringID(), "url": badgeURL(r, k.StringID())})
+}
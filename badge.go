@@ -4,16 +4,37 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"appengine/memcache"
+	"appengine/taskqueue"
 	"appengine/urlfetch"
+	"bytes"
 	"code.google.com/p/goauth2/oauth"
 	"code.google.com/p/google-api-go-client/analytics/v3"
+	"code.google.com/p/google-api-go-client/googleapi"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
-	"math/rand"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 )
 
 type Account struct {
@@ -21,27 +42,62 @@ type Account struct {
 	AccessToken  string
 	RefreshToken string
 	Expiry       time.Time
+	// APIKeyHash is the hash of a key scripts can sign in with, if minted.
+	APIKeyHash string
 }
 
+// GetToken returns the account's token, or nil if it has none or it can't be
+// decrypted, either of which means signing in again.
 func (a *Account) GetToken() *oauth.Token {
 	if a.AccessToken == "" {
 		return nil
 	}
+	access, err := unseal(a.AccessToken)
+	if err != nil {
+		return nil
+	}
+	refresh, err := unseal(a.RefreshToken)
+	if err != nil {
+		return nil
+	}
 	return &oauth.Token{
-		AccessToken:  a.AccessToken,
-		RefreshToken: a.RefreshToken,
+		AccessToken:  access,
+		RefreshToken: refresh,
 		Expiry:       a.Expiry,
 	}
 }
 
 func (a *Account) SetToken(t *oauth.Token) {
-	a.AccessToken = t.AccessToken
+	a.AccessToken = seal(t.AccessToken)
 	if t.RefreshToken != "" {
-		a.RefreshToken = t.RefreshToken
+		a.RefreshToken = seal(t.RefreshToken)
 	}
 	a.Expiry = t.Expiry
 }
 
+// Equal reports whether two accounts would be saved the same. Expiry is
+// compared with Equal rather than ==, for the same reason as in TokenChanged.
+func (a Account) Equal(b Account) bool {
+	return a.Username == b.Username &&
+		a.AccessToken == b.AccessToken &&
+		a.RefreshToken == b.RefreshToken &&
+		a.Expiry.Equal(b.Expiry) &&
+		a.APIKeyHash == b.APIKeyHash
+}
+
+// TokenChanged reports whether SetToken would change the account. Expiry is
+// compared with Equal, as freshly parsed and loaded times differ in location
+// and monotonic clock reading even when they're the same instant.
+func (a *Account) TokenChanged(t *oauth.Token) bool {
+	current := a.GetToken()
+	if current == nil {
+		return true
+	}
+	return t.AccessToken != current.AccessToken ||
+		t.RefreshToken != "" && t.RefreshToken != current.RefreshToken ||
+		!t.Expiry.Equal(a.Expiry)
+}
+
 type Session struct {
 	Id      string
 	Account Account
@@ -55,62 +111,486 @@ func (s *Session) Key(c appengine.Context) *datastore.Key {
 	return datastore.NewKey(c, "Account", s.Account.Username, 0, nil)
 }
 
+// Clear signs the session out, without persisting the emptied Account.
+func (s *Session) Clear(c appengine.Context) {
+	if err := memcache.Delete(cache(c), "s:"+s.Id); err != nil && err != memcache.ErrCacheMiss {
+		c.Errorf("memcache.Delete error: %#v", err)
+	}
+	s.Account = Account{}
+	s.Loaded = Account{}
+}
+
+// Flash stores a message to show on the next page the session loads.
+func (s *Session) Flash(c appengine.Context, message string) {
+	item := &memcache.Item{
+		Key:        "flash:" + s.Id,
+		Value:      []byte(message),
+		Expiration: 10 * time.Minute,
+	}
+	if err := memcache.Set(cache(c), item); err != nil {
+		c.Errorf("memcache.Set error: %#v", err)
+	}
+}
+
+// Flashed returns and removes the session's flash message, if any.
+func (s *Session) Flashed(c appengine.Context) string {
+	item, err := memcache.Get(cache(c), "flash:"+s.Id)
+	if err != nil {
+		return ""
+	}
+	if err := memcache.Delete(cache(c), "flash:"+s.Id); err != nil {
+		c.Errorf("memcache.Delete error: %#v", err)
+	}
+	return string(item.Value)
+}
+
 type Property struct {
-	Account *datastore.Key
-	Id      string
-	Profile string
+	Account  *datastore.Key
+	Id       string
+	Profile  string
+	Profiles []string
+	CacheTTL time.Duration
+	// HourlyLimit caps how often badges may query Analytics per hour.
+	HourlyLimit int
+	Thresholds  Thresholds
+	// AllowedReferers restricts which sites may embed the badges, if set.
+	// Requests without a Referer, such as direct loads, are always allowed.
+	AllowedReferers []string
+	// Display names, refreshed whenever manage loads the account summaries.
+	Name        string
+	AccountName string
+
+	DefaultMetric string
+	DefaultRange  string
+	// Target, if set, shows default badges as a percentage of it.
+	Target int
+	// Invalidated is when the owner last asked for the badges to be
+	// refetched, so values saved before then aren't served while stale.
+	Invalidated time.Time
+}
+
+// ttl clamps the owner's chosen cache lifetime, to protect the Analytics quota.
+func (p *Property) ttl() time.Duration {
+	switch {
+	case p.CacheTTL == 0:
+		return 12 * time.Hour
+	case p.CacheTTL < 5*time.Minute:
+		return 5 * time.Minute
+	case p.CacheTTL > 24*time.Hour:
+		return 24 * time.Hour
+	}
+	return p.CacheTTL
+}
+
+// limit is the owner's chosen hourly query limit, defaulting to 60.
+func (p *Property) limit() int {
+	switch {
+	case p.HourlyLimit <= 0:
+		return 60
+	case p.HourlyLimit > 1000:
+		return 1000
+	}
+	return p.HourlyLimit
+}
+
+// allow counts a query against the property's hourly limit, reporting whether
+// it's within the limit. The count is in memcache, so is best effort.
+func (p *Property) allow(c appengine.Context) bool {
+	key := "limit:" + propertyKey(c, p.Account, p.Id).StringID() + ":" + strconv.FormatInt(time.Now().Unix()/3600, 10)
+	memcache.Add(cache(c), &memcache.Item{Key: key, Value: []byte("0"), Expiration: time.Hour})
+	n, err := memcache.Increment(cache(c), key, 1, 0)
+	if err != nil {
+		c.Errorf("allow(Memcache) error: %#v", err)
+		return true
+	}
+	return n <= uint64(p.limit())
+}
+
+// usageKey is the memcache key counting a property's queries on a UTC day,
+// kept apart for each account sharing the Analytics property.
+func usageKey(c appengine.Context, p *Property, day time.Time) string {
+	return "usage:" + propertyKey(c, p.Account, p.Id).StringID() + ":" + day.UTC().Format("20060102")
+}
+
+// used counts an Analytics query made for the property today.
+func (p *Property) used(c appengine.Context) {
+	gaFetches.inc()
+	key := usageKey(c, p, time.Now())
+	memcache.Add(cache(c), &memcache.Item{Key: key, Value: []byte("0"), Expiration: 48 * time.Hour})
+	if _, err := memcache.Increment(cache(c), key, 1, 0); err != nil {
+		c.Errorf("used(Memcache) error: %#v", err)
+	}
+}
+
+// embeddable reports whether the request's Referer may show the badges.
+func (p *Property) embeddable(r *http.Request) bool {
+	if len(p.AllowedReferers) == 0 || r.Referer() == "" {
+		return true
+	}
+	u, err := url.Parse(r.Referer())
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	for _, allowed := range p.AllowedReferers {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddableHere is embeddable for handlers, which also need caches to keep
+// the answer per referer, and not to keep a refusal at all.
+func (p *Property) embeddableHere(w http.ResponseWriter, r *http.Request) bool {
+	if len(p.AllowedReferers) > 0 {
+		w.Header().Add("Vary", "Referer")
+	}
+	if !p.embeddable(r) {
+		w.Header().Set("Cache-Control", "no-cache")
+		return false
+	}
+	return true
+}
+
+// referers parses the hosts an owner lists, one per line or comma separated,
+// accepting full URLs and host:port too.
+func referers(list string) []string {
+	var hosts []string
+	for _, field := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if u, err := url.Parse(field); err == nil && u.Host != "" {
+			field = u.Host
+		}
+		host := strings.ToLower(strings.Split(field, "/")[0])
+		// Referers are matched without their port, so drop any given here.
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		if validHost.MatchString(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+var validHost = regexp.MustCompile(`^[a-z0-9.-]+$`)
+
+var errProfile = errors.New("profile not allowed")
+
+// profile returns the view a badge reads from, which must be the default or
+// one the owner has allowed to be chosen in the badge URL.
+func (p *Property) profile(b *Badge) (string, error) {
+	// Saved before disabling removed the property.
+	if p.Profile == "" {
+		return "", errNotFound
+	}
+	if b.Profile == "" || b.Profile == p.Profile {
+		return p.Profile, nil
+	}
+	for _, allowed := range p.Profiles {
+		if allowed == b.Profile {
+			return allowed, nil
+		}
+	}
+	return "", errProfile
+}
+
+// Value records the last totals fetched for a badge variant, as a child of its
+// Property, so a badge can still be drawn when memcache is empty and the
+// Analytics API is failing.
+type Value struct {
+	Profile  string
+	Cached   string
+	CachedAt time.Time
+	TTL      time.Duration
+	Values   []string `datastore:"-"`
+
+	// Previous holds the values for the window before, for trend badges.
+	Previous       string
+	PreviousValues []string `datastore:"-"`
+}
+
+// MaxAge is how much longer the value may be cached, in seconds.
+func (v *Value) MaxAge() int {
+	ttl := v.TTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	remaining := int((ttl - time.Since(v.CachedAt)) / time.Second)
+	if remaining < 60 {
+		return 60
+	}
+	return remaining
+}
+
+// ago describes how long ago the value was fetched, coarsely enough that
+// rendered badges stay cacheable.
+func (v *Value) ago() string {
+	d := time.Since(v.CachedAt)
+	switch {
+	case d < time.Minute:
+		return "Updated just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute")
+	case d < 48*time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	}
+	return plural(int(d/(24*time.Hour)), "day")
+}
+
+func plural(n int, unit string) string {
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("Updated %d %s ago", n, unit)
+}
+
+// sessionTTL is how long a session lasts since the user's last request.
+const sessionTTL = time.Hour
+
+// setSessionCookie sets the session cookie, only marked Secure in production
+// so login still works over plain http on the development server. The go1
+// runtime's http.Cookie predates SameSite, so it's appended by hand.
+func setSessionCookie(w http.ResponseWriter, value string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:     "session",
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   !appengine.IsDevAppServer(),
+	}
+	w.Header().Add("Set-Cookie", cookie.String()+"; SameSite=Lax")
+}
+
+func transport(c appengine.Context, a *Account) *oauth.Transport {
+	t := &oauth.Transport{Config: &config, Transport: &urlfetch.Transport{Context: c}}
+	t.Token = a.GetToken()
+	return t
+}
+
+// saveToken persists the account if its token was refreshed by the transport.
+func saveToken(c appengine.Context, k *datastore.Key, a *Account, t *oauth.Transport) {
+	if t.Token == nil || !a.TokenChanged(t.Token) {
+		return
+	}
+	a.SetToken(t.Token)
+	// SetToken keeps the refresh token unless Google sent a new one, which
+	// may still be plaintext.
+	a.Seal()
+	if _, err := datastore.Put(c, k, a); err != nil {
+		c.Errorf("saveToken error: %#v", err)
+	}
+}
+
+// Secret holds the key session cookies are signed with.
+type Secret struct {
+	Key []byte
+}
+
+var (
+	secretMutex sync.Mutex
+	secret      []byte
+)
+
+// signingKey loads the session signing key, generating one on first use.
+func signingKey(c appengine.Context) ([]byte, error) {
+	secretMutex.Lock()
+	defer secretMutex.Unlock()
+	if secret != nil {
+		return secret, nil
+	}
+	k := datastore.NewKey(c, "Secret", "session", 0, nil)
+	var stored Secret
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		err := datastore.Get(c, k, &stored)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		stored.Key = make([]byte, 32)
+		if _, err := rand.Read(stored.Key); err != nil {
+			return err
+		}
+		_, err = datastore.Put(c, k, &stored)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	secret = stored.Key
+	return secret, nil
+}
+
+// randomId returns 128 random bits, hex encoded so they're cookie and URL safe.
+func randomId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func signature(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func sign(key []byte, id string) string {
+	return id + "." + signature(key, id)
+}
+
+// verify returns the session id from a signed cookie value, or "" if the
+// signature doesn't match.
+func verify(key []byte, value string) string {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return ""
+	}
+	id := value[:i]
+	if !hmac.Equal([]byte(value[i+1:]), []byte(signature(key, id))) {
+		return ""
+	}
+	return id
 }
 
 type Wrapper func(http.ResponseWriter, *http.Request, *Session) error
 
-func (fn Wrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// statusWriter records the status a handler responds with, for logging.
+type statusWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (fn Wrapper) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
+	if misconfigured != nil {
+		c.Errorf("Configuration error: %v", misconfigured)
+		http.Error(rw, "Analytics Badge is down for maintenance. Please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	w := &statusWriter{ResponseWriter: rw}
+	start := time.Now()
 	s := &Session{}
-	cookie, err := r.Cookie("session")
-	if err == nil {
-		s.Id = cookie.Value
-		item, err := memcache.Get(c, "s:"+s.Id)
-		if err == nil {
-			s.Account = Account{
-				Username: string(item.Value),
-			}
-			if err := datastore.Get(c, s.Key(c), &s.Account); err != nil {
-				c.Errorf("datastore.Get error: %#v", err)
-				http.Redirect(w, r, "/", http.StatusFound)
-				return
+	var handlerErr error
+	defer func() {
+		if p := recover(); p != nil {
+			handlerErr = fmt.Errorf("panic: %v", p)
+			c.Errorf("Handler panic: %v\n%s", p, debug.Stack())
+			if w.Status == 0 {
+				http.Error(w, "Something went wrong. Please try again later.", http.StatusInternalServerError)
 			}
-			s.Loaded = s.Account
 		}
-	} else {
-		s.Id = strconv.FormatInt(rand.Int63(), 36)
-		cookie := &http.Cookie{
-			Name:   "session",
-			Value:  s.Id,
-			MaxAge: 3600,
+		c.Infof("request method=%s path=%q session=%t user=%q status=%d duration=%v error=%v",
+			r.Method, r.URL.Path, s.Loaded.Username != "", s.Account.Username, w.Status, time.Since(start), handlerErr)
+	}()
+	if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		// Scripts sign in with an API key instead of a session cookie.
+		a, err := accountByKey(c, strings.TrimPrefix(bearer, "Bearer "))
+		if err != nil {
+			c.Warningf("accountByKey error: %#v", err)
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
 		}
-		http.SetCookie(w, cookie)
-	}
-	if err := fn(w, r, s); err != nil {
-		c.Errorf("Handler error: %#v", err)
+		s.Account = *a
+		s.Loaded = s.Account
+	} else if err := s.load(c, w, r); err != nil {
+		c.Errorf("Session error: %#v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	if s.Loaded != s.Account {
-		item := &memcache.Item{
-			Key:        "s:" + s.Id,
-			Value:      []byte(s.Account.Username),
-			Expiration: time.Hour,
+	if handlerErr = fn(w, r, s); handlerErr != nil {
+		c.Errorf("Handler error: %#v", handlerErr)
+		http.Error(w, handlerErr.Error(), 500)
+		return
+	}
+	// Without a username the key would be incomplete, and every write would
+	// create another orphaned Account.
+	if s.Account.Username == "" {
+		if !s.Loaded.Equal(s.Account) {
+			c.Warningf("Not persisting an account without a username")
 		}
-		if err := memcache.Set(c, item); err != nil {
-			c.Errorf("Memcache write error: %#v", err)
+		return
+	}
+	if !s.Loaded.Equal(s.Account) {
+		// API key requests have no session to update.
+		if s.Id != "" {
+			item := &memcache.Item{
+				Key:        "s:" + s.Id,
+				Value:      []byte(s.Account.Username),
+				Expiration: sessionTTL,
+			}
+			if err := memcache.Set(cache(c), item); err != nil {
+				c.Errorf("Memcache write error: %#v", err)
+			}
 		}
-		_, err = datastore.Put(c, s.Key(c), &s.Account)
+		s.Account.Seal()
+		_, err := datastore.Put(c, s.Key(c), &s.Account)
 		if err != nil {
 			c.Errorf("datastore.Put write error: %#v", err)
 		}
 	}
 }
 
+// load reads the session from its cookie, extending it if it's signed in, or
+// starts a new one.
+func (s *Session) load(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	key, err := signingKey(c)
+	if err != nil {
+		return err
+	}
+	if cookie, err := r.Cookie("session"); err == nil {
+		s.Id = verify(key, cookie.Value)
+	}
+	if s.Id == "" {
+		if s.Id, err = randomId(); err != nil {
+			return err
+		}
+		setSessionCookie(w, sign(key, s.Id), int(sessionTTL/time.Second))
+		return nil
+	}
+	item, err := memcache.Get(cache(c), "s:"+s.Id)
+	if err != nil {
+		return nil
+	}
+	s.Account = Account{
+		Username: string(item.Value),
+	}
+	// Fall back to signed out, since redirecting to / would loop.
+	if err := datastore.Get(c, s.Key(c), &s.Account); err != nil {
+		c.Errorf("datastore.Get error: %#v", err)
+		s.Account = Account{}
+	} else {
+		// Slide the expiry along, so active users stay signed in.
+		item.Expiration = sessionTTL
+		if err := memcache.Set(cache(c), item); err != nil {
+			c.Errorf("Memcache refresh error: %#v", err)
+		}
+		setSessionCookie(w, sign(key, s.Id), int(sessionTTL/time.Second))
+	}
+	s.Loaded = s.Account
+	// Tokens saved in plaintext are encrypted on this request's write.
+	s.Account.Seal()
+	return nil
+}
+
 type Config struct {
 	Web struct {
 		AuthUri      string   `json:"auth_uri"`
@@ -119,84 +599,347 @@ type Config struct {
 		RedirectURIs []string `json:"redirect_uris"`
 		TokenURI     string   `json:"token_uri"`
 	}
+	// Scope optionally replaces the read only Analytics scope, and may in
+	// turn be overridden by the ANALYTICS_SCOPE environment variable.
+	Scope string `json:"scope"`
+}
+
+const readonlyScope = "https://www.googleapis.com/auth/analytics.readonly"
+
+// Scopes which may be requested in place of readonlyScope.
+var scopes = map[string]bool{
+	readonlyScope: true,
+	"https://www.googleapis.com/auth/analytics":                       true,
+	"https://www.googleapis.com/auth/analytics.edit":                  true,
+	"https://www.googleapis.com/auth/analytics.manage.users":          true,
+	"https://www.googleapis.com/auth/analytics.manage.users.readonly": true,
+}
+
+// scope validates a space separated list of scopes, falling back to read only.
+func scope(requested string) string {
+	if requested == "" {
+		return readonlyScope
+	}
+	for _, s := range strings.Fields(requested) {
+		if !scopes[s] {
+			log.Printf("init warning: ignoring unknown Analytics scope %q", s)
+			return readonlyScope
+		}
+	}
+	return strings.Join(strings.Fields(requested), " ")
 }
 
 var (
-	config    oauth.Config
-	templates = template.Must(template.ParseGlob("templates/[^.]*"))
+	config oauth.Config
+	// redirectURIs are all of client_secrets.json's redirect URIs, so one
+	// deployment can sign in on each host they're registered for.
+	redirectURIs []string
+	templates    = template.New("")
+	// misconfigured is why the site's pages can't be served, if they can't.
+	misconfigured error
+	// namespace separates this deployment's memcache keys from others
+	// sharing the same memcache.
+	namespace = os.Getenv("MEMCACHE_NAMESPACE")
 )
 
+var validNamespace = regexp.MustCompile(`^[0-9A-Za-z._-]{0,100}$`)
+
 func init() {
-	rand.Seed(time.Now().UnixNano())
-	// Retrieved from https://console.developers.google.com/project after enabling the analytics API.
-	file, _ := ioutil.ReadFile("client_secrets.json")
-	var parsed Config
-	json.Unmarshal(file, &parsed)
+	if parsed, err := template.ParseGlob("templates/[^.]*"); err != nil {
+		log.Printf("init(Templates) error: %v", err)
+		misconfigured = err
+	} else {
+		templates = parsed
+	}
 	config = oauth.Config{
 		AccessType:     "offline",
 		ApprovalPrompt: "force",
-		Scope:          "https://www.googleapis.com/auth/analytics.readonly",
-		AuthURL:        parsed.Web.AuthUri,
-		ClientId:       parsed.Web.ClientId,
-		ClientSecret:   parsed.Web.ClientSecret,
-		RedirectURL:    parsed.Web.RedirectURIs[0],
-		TokenURL:       parsed.Web.TokenURI,
-	}
-	http.HandleFunc("/", index)
+		Scope:          scope(os.Getenv("ANALYTICS_SCOPE")),
+	}
+	// Retrieved from https://console.developers.google.com/project after enabling the analytics API.
+	if file, err := ioutil.ReadFile("client_secrets.json"); err != nil {
+		log.Printf("init(Secrets) error: %v", err)
+	} else {
+		var parsed Config
+		if err := json.Unmarshal(file, &parsed); err != nil {
+			log.Printf("init(Secrets) error: client_secrets.json is malformed: %v", err)
+		}
+		config.AuthURL = parsed.Web.AuthUri
+		config.ClientId = parsed.Web.ClientId
+		config.ClientSecret = parsed.Web.ClientSecret
+		config.TokenURL = parsed.Web.TokenURI
+		if os.Getenv("ANALYTICS_SCOPE") == "" {
+			config.Scope = scope(parsed.Scope)
+		}
+		if len(parsed.Web.RedirectURIs) > 0 {
+			config.RedirectURL = parsed.Web.RedirectURIs[0]
+		}
+		redirectURIs = parsed.Web.RedirectURIs
+	}
+	if key := os.Getenv("TOKEN_KEY"); key != "" {
+		parsed, err := parseTokenKey(key)
+		if err != nil {
+			log.Printf("init(TokenKey) error: %v", err)
+			misconfigured = err
+		}
+		tokenKey = parsed
+	}
+	if !validNamespace.MatchString(namespace) {
+		log.Printf("init warning: ignoring invalid memcache namespace %q", namespace)
+		namespace = ""
+	}
+	if config.ClientId == "" || config.RedirectURL == "" {
+		log.Printf("init warning: client_secrets.json has no client id or redirect URI, so signing in is disabled")
+		if misconfigured == nil {
+			misconfigured = errors.New("missing OAuth client secrets")
+		}
+	}
+	http.Handle("/", Wrapper(index))
 	http.HandleFunc("/badge/", badge)
+	http.HandleFunc("/data/", data)
+	http.HandleFunc("/embed/", embed)
+	http.HandleFunc("/sparkline/", sparkline)
+	http.HandleFunc("/hero/", hero)
+	http.HandleFunc("/split/", split)
+	http.HandleFunc("/static.svg", staticBadge)
+	http.HandleFunc("/static.png", staticBadge)
+	http.HandleFunc("/cron/refresh", refresh)
+	http.HandleFunc("/cron/tokens", refreshTokens)
+	http.HandleFunc("/tasks/revalidate", revalidateTask)
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/metrics", stats)
+	http.HandleFunc("/admin/stale", stale)
 	http.Handle("/manage", Wrapper(manage))
+	http.Handle("/api/badges", Wrapper(listBadges))
+	http.Handle("/api/key", Wrapper(apiKey))
+	http.Handle("/api/properties", Wrapper(apiProperties))
+	http.Handle("/export", Wrapper(exportProperties))
+	http.Handle("/import", Wrapper(importProperties))
+	http.Handle("/invalidate", Wrapper(invalidateBadge))
 	http.Handle("/oauth", Wrapper(auth))
+	http.Handle("/logout", Wrapper(logout))
+	http.Handle("/disconnect", Wrapper(disconnect))
+}
+
+// deleteProperties removes properties along with their cached values.
+func deleteProperties(c appengine.Context, keys []*datastore.Key) error {
+	var ids []string
+	var values []*datastore.Key
+	for _, k := range keys {
+		ids = append(ids, k.StringID())
+		children, err := datastore.NewQuery("Value").Ancestor(k).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		values = append(values, children...)
+	}
+	if err := datastore.DeleteMulti(c, append(values, keys...)); err != nil {
+		return err
+	}
+	invalidate(c, ids...)
+	return nil
+}
+
+// propertyKey is where an account keeps its settings for a property. The
+// owner's hash is part of the name, so accounts sharing an Analytics property
+// each get their own badges, while badge URLs don't reveal the username.
+func propertyKey(c appengine.Context, account *datastore.Key, id string) *datastore.Key {
+	sum := sha1.Sum([]byte(account.StringID()))
+	return datastore.NewKey(c, "Property", hex.EncodeToString(sum[:8])+"/"+id, 0, nil)
+}
+
+// ownedKeys maps the ids of an account's properties to their keys, which for
+// properties saved before keys were scoped are just the id.
+func ownedKeys(c appengine.Context, account *datastore.Key) (map[string]*datastore.Key, error) {
+	var properties []Property
+	keys, err := datastore.NewQuery("Property").Filter("Account =", account).GetAll(c, &properties)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]*datastore.Key)
+	for i, p := range properties {
+		owned[p.Id] = keys[i]
+	}
+	return owned, nil
+}
+
+// summaries loads every page of the user's account summaries.
+func summaries(a *analytics.Service) (*analytics.AccountSummaries, error) {
+	all, err := a.Management.AccountSummaries.List().Do()
+	if err != nil {
+		return nil, err
+	}
+	page := all
+	for page.NextLink != "" {
+		page, err = a.Management.AccountSummaries.List().StartIndex(page.StartIndex + page.ItemsPerPage).Do()
+		if err != nil {
+			return nil, fmt.Errorf("loading account summaries from %d: %v", len(all.Items)+1, err)
+		}
+		all.Items = append(all.Items, page.Items...)
+	}
+	all.NextLink = ""
+	return all, nil
+}
+
+// visible lists the Analytics properties an account can see. It also maps
+// each property id to the ids of its profiles, and to the names of the
+// property and its account. Either API failing only hides its properties,
+// unless both fail.
+func visible(c appengine.Context, t *oauth.Transport) (*analytics.AccountSummaries, map[string]map[string]bool, map[string][2]string, error) {
+	a, err := analytics.New(t.Client())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	accounts, uaErr := summaries(a)
+	if uaErr != nil {
+		c.Errorf("visible(UA) error: %#v", uaErr)
+		accounts = &analytics.AccountSummaries{}
+	}
+	// GA4 properties are only listed by the Admin API, which may not be enabled.
+	if more, err := ga4Summaries(t.Client()); err != nil {
+		c.Errorf("visible(GA4) error: %#v", err)
+		if uaErr != nil {
+			return nil, nil, nil, uaErr
+		}
+	} else {
+		accounts.Items = append(accounts.Items, more...)
+	}
+	loaded := make(map[string]map[string]bool)
+	names := make(map[string][2]string)
+	for _, account := range accounts.Items {
+		for _, property := range account.WebProperties {
+			names[property.Id] = [2]string{property.Name, account.Name}
+			loaded[property.Id] = make(map[string]bool)
+			for _, profile := range property.Profiles {
+				loaded[property.Id][profile.Id] = true
+			}
+		}
+	}
+	return accounts, loaded, names, nil
 }
 
 func manage(w http.ResponseWriter, r *http.Request, s *Session) error {
 	c := appengine.NewContext(r)
-	t := &oauth.Transport{Config: &config, Transport: &urlfetch.Transport{Context: c}}
-	t.Token = s.Account.GetToken()
+	manageRequests.inc()
+	t := transport(c, &s.Account)
 	if t.Token == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return nil
 	}
-	a, err := analytics.New(t.Client())
-	if err != nil {
-		return err
-	}
-	accounts, err := a.Management.AccountSummaries.List().Do()
+	accounts, loaded, names, err := visible(c, t)
 	if err != nil {
 		return err
 	}
-	loaded := make(map[string]bool)
-	for _, account := range accounts.Items {
-		for _, property := range account.WebProperties {
-			loaded[property.Id] = true
-		}
+	if s.Account.TokenChanged(t.Token) {
+		s.Account.SetToken(t.Token)
 	}
-	s.Account.SetToken(t.Token)
 	if r.Method == "POST" {
 		w.Header().Set("Content-Type", "text/html")
 		r.ParseForm()
+		owned, err := ownedKeys(c, s.Key(c))
+		if err != nil {
+			return err
+		}
+		if id := r.FormValue("delete"); id != "" {
+			k, ok := owned[id]
+			if !ok {
+				return errors.New("property is not configured by this account")
+			}
+			if err := deleteProperties(c, []*datastore.Key{k}); err != nil {
+				return err
+			}
+			http.Redirect(w, r, "/manage", http.StatusFound)
+			return nil
+		}
 		var keys []*datastore.Key
 		var properties []*Property
-		var cache []string
+		var ids []string
+		var disabled []*datastore.Key
+		var invalid []string
 		for id := range r.Form {
-			if !loaded[id] {
+			if loaded[id] == nil {
 				continue
 			}
 			profile := r.FormValue(id)
+			// Disabled properties are removed, rather than kept without a
+			// profile for badges to fail on.
+			if profile == "" {
+				if k, ok := owned[id]; ok {
+					disabled = append(disabled, k)
+				}
+				continue
+			}
+			if !loaded[id][profile] {
+				invalid = append(invalid, id)
+				continue
+			}
 			p := &Property{
-				Account: s.Key(c),
-				Id:      id,
-				Profile: profile,
+				Account:     s.Key(c),
+				Id:          id,
+				Profile:     profile,
+				Name:        names[id][0],
+				AccountName: names[id][1],
+			}
+			for _, allowed := range r.Form[id+".allowed"] {
+				if loaded[id][allowed] {
+					p.Profiles = append(p.Profiles, allowed)
+				}
+			}
+			if minutes, err := strconv.Atoi(r.FormValue(id + ".ttl")); err == nil {
+				p.CacheTTL = time.Duration(minutes) * time.Minute
+				p.CacheTTL = p.ttl()
+			}
+			if n, err := strconv.Atoi(r.FormValue(id + ".limit")); err == nil {
+				p.HourlyLimit = n
+				p.HourlyLimit = p.limit()
+			}
+			p.AllowedReferers = referers(r.FormValue(id + ".referers"))
+			yellow, yerr := strconv.Atoi(r.FormValue(id + ".yellow"))
+			green, gerr := strconv.Atoi(r.FormValue(id + ".green"))
+			// The defaults are left unset, so metrics with their own tiers use them.
+			th := Thresholds{Yellow: yellow, Green: green, Invert: r.FormValue(id+".invert") != ""}
+			if yerr == nil && gerr == nil && th.valid() && th != defaultThresholds {
+				p.Thresholds = th
 			}
-			keys = append(keys, datastore.NewKey(c, "Property", p.Id, 0, nil))
+			if m := r.FormValue(id + ".metric"); metrics[m].Label != "" {
+				p.DefaultMetric = m
+			}
+			if rng := r.FormValue(id + ".range"); ranges[rng].Start != "" {
+				p.DefaultRange = rng
+			}
+			if n, err := strconv.Atoi(r.FormValue(id + ".target")); err == nil && n > 0 {
+				p.Target = n
+			}
+			// Saving again updates the same entity, which is the account's
+			// own, so other accounts' badges for the property are untouched.
+			k, ok := owned[id]
+			if !ok {
+				k = propertyKey(c, s.Key(c), id)
+			}
+			keys = append(keys, k)
 			properties = append(properties, p)
-			cache = append(cache, "b:"+p.Id)
+			ids = append(ids, k.StringID())
 		}
-		_, err := datastore.PutMulti(c, keys, properties)
+		if r.FormValue("preview") != "" {
+			err := preview(w, c, t, keys, properties)
+			if s.Account.TokenChanged(t.Token) {
+				s.Account.SetToken(t.Token)
+			}
+			return err
+		}
+		_, err = datastore.PutMulti(c, keys, properties)
 		if err != nil {
 			c.Errorf("datastore.PutMulti error: %#v", err)
 		}
-		if err = memcache.DeleteMulti(c, cache); err != nil {
-			c.Errorf("memcache.DeleteMulti error: %#v", err)
+		invalidate(c, ids...)
+		if len(disabled) > 0 {
+			if err := deleteProperties(c, disabled); err != nil {
+				c.Errorf("manage(Disable) error: %#v", err)
+			}
+		}
+		if len(invalid) > 0 {
+			sort.Strings(invalid)
+			s.Flash(c, "Not saved, as the chosen view isn't available: "+strings.Join(invalid, ", "))
 		}
 		http.Redirect(w, r, "/manage", http.StatusFound)
 		return nil
@@ -205,155 +948,2330 @@ func manage(w http.ResponseWriter, r *http.Request, s *Session) error {
 	params := &struct {
 		Accounts *analytics.AccountSummaries
 		Profiles map[string]string
+		Allowed  map[string]map[string]bool
+		TTLs     map[string]int
+		Limits   map[string]int
+		Defaults map[string]Property
+		Metrics  []string
+		Ranges   []string
+		Badges   []map[string]string
+		Keys     map[string]string
+		Usage    map[string]uint64
+		Total    uint64
+		Flash    string
 	}{
 		accounts,
 		make(map[string]string),
+		make(map[string]map[string]bool),
+		make(map[string]int),
+		make(map[string]int),
+		make(map[string]Property),
+		nil,
+		nil,
+		nil,
+		make(map[string]string),
+		make(map[string]uint64),
+		0,
+		s.Flashed(c),
+	}
+	for m := range metrics {
+		params.Metrics = append(params.Metrics, m)
 	}
+	sort.Strings(params.Metrics)
+	for rng := range ranges {
+		params.Ranges = append(params.Ranges, rng)
+	}
+	sort.Strings(params.Ranges)
 	var properties []Property
 	q := datastore.NewQuery("Property").Filter("Account =", s.Key(c))
-	q.GetAll(c, &properties)
-	for _, p := range properties {
-		params.Profiles[p.Id] = p.Profile
+	keys, _ := q.GetAll(c, &properties)
+	var renamedKeys []*datastore.Key
+	var renamed []*Property
+	for i := range properties {
+		p := &properties[i]
+		if n, ok := names[p.Id]; ok && (p.Name != n[0] || p.AccountName != n[1]) {
+			p.Name, p.AccountName = n[0], n[1]
+			renamedKeys = append(renamedKeys, keys[i])
+			renamed = append(renamed, p)
+		}
 	}
-	templates.ExecuteTemplate(w, "manage.html", params)
-	return nil
-}
-
+	if len(renamed) > 0 {
+		if _, err := datastore.PutMulti(c, renamedKeys, renamed); err != nil {
+			c.Errorf("manage(Names) error: %#v", err)
+		}
+	}
+	var usageKeys []string
+	for i := range properties {
+		usageKeys = append(usageKeys, usageKey(c, &properties[i], time.Now()))
+	}
+	if usage, err := memcache.GetMulti(cache(c), usageKeys); err != nil {
+		c.Errorf("manage(Usage) error: %#v", err)
+	} else {
+		for i, p := range properties {
+			if item, ok := usage[usageKeys[i]]; ok {
+				n, _ := strconv.ParseUint(string(item.Value), 10, 64)
+				params.Usage[p.Id] = n
+				params.Total += n
+			}
+		}
+	}
+	params.Badges = snippets(r, keys, properties)
+	for i, p := range properties {
+		params.Keys[p.Id] = keys[i].StringID()
+		params.Profiles[p.Id] = p.Profile
+		params.TTLs[p.Id] = int(p.ttl() / time.Minute)
+		params.Limits[p.Id] = p.limit()
+		params.Defaults[p.Id] = p
+		params.Allowed[p.Id] = make(map[string]bool)
+		for _, allowed := range p.Profiles {
+			params.Allowed[p.Id][allowed] = true
+		}
+	}
+	return respond(w, http.StatusOK, "manage.html", params)
+}
+
+// preview shows what the default badge of each submitted property would say
+// now, straight from Analytics, without saving the settings.
+func preview(w http.ResponseWriter, c appengine.Context, t *oauth.Transport, keys []*datastore.Key, properties []*Property) error {
+	var previews []map[string]interface{}
+	for i, p := range properties {
+		m := or(p.DefaultMetric, "ga:users")
+		b := &Badge{
+			Id:         keys[i].StringID(),
+			Metrics:    []string{m},
+			Range:      or(p.DefaultRange, "7d"),
+			Label:      metrics[m].Label,
+			Thresholds: p.Thresholds,
+		}
+		right, color := "", "#9f9f9f"
+		var v *Value
+		err := errRateLimited
+		if p.allow(c) {
+			v, err = live(c, t, p, b)
+		}
+		switch err {
+		case nil:
+			right, color = b.message(v.Values)
+		case errRateLimited, errAuthExpired, errGA4Metric:
+			right = err.Error()
+		default:
+			c.Errorf("preview(%s) error: %#v", p.Id, err)
+			right = "error"
+		}
+		image, err := RenderBadge(b.Label, right, color)
+		if err != nil {
+			return err
+		}
+		previews = append(previews, map[string]interface{}{
+			"Name":  or(p.Name, p.Id),
+			"Image": template.URL("data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(image)),
+		})
+	}
+	return respond(w, http.StatusOK, "preview.html", previews)
+}
+
 func auth(w http.ResponseWriter, r *http.Request, s *Session) error {
 	c := appengine.NewContext(r)
-	t := &oauth.Transport{Config: &config, Transport: &urlfetch.Transport{Context: c}}
-	token := s.Account.GetToken()
-	if token != nil {
-		t.Token = token
+	item, err := memcache.Get(cache(c), "state:"+s.Id)
+	if err != nil || r.FormValue("state") == "" || r.FormValue("state") != string(item.Value) {
+		// Usually a sign in left open too long, or finished in another tab.
+		return authFailed(w, r, s, "the sign in expired or was started elsewhere.")
 	}
-	t.Exchange(r.FormValue("code"))
-	a, err := analytics.New(t.Client())
-	if err != nil {
-		return err
+	if err := memcache.Delete(cache(c), "state:"+s.Id); err != nil {
+		c.Errorf("memcache.Delete error: %#v", err)
+	}
+	if e := r.FormValue("error"); e != "" {
+		c.Infof("auth(Consent) error: %q", e)
+		reason := "Google reported " + e + "."
+		if e == "access_denied" {
+			reason = "access to Google Analytics was not granted."
+		}
+		return authFailed(w, r, s, reason)
+	}
+	t := transport(c, &s.Account)
+	t.Config = redirectConfig(r)
+	if _, err := t.Exchange(r.FormValue("code")); err != nil {
+		c.Errorf("auth(Exchange) error: %#v", err)
+		return authFailed(w, r, s, "Google didn't accept the sign in. It may have expired.")
 	}
-	accounts, err := a.Management.AccountSummaries.List().Do()
+	accounts, _, _, err := visible(c, t)
 	if err != nil {
 		return err
 	}
-	// Error out if no associated properties?
+	// Only Universal Analytics says who signed in.
+	if accounts.Username == "" {
+		return authFailed(w, r, s, "Google Analytics didn't say which Google account signed in.")
+	}
+	if len(accounts.Items) == 0 {
+		s.Flash(c, "The Google account "+accounts.Username+" doesn't have access to any Google Analytics accounts.")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
 	s.Account.Username = accounts.Username
 	s.Account.SetToken(t.Token)
+	authSuccesses.inc()
 	http.Redirect(w, r, "/manage", http.StatusFound)
 	return nil
 }
 
-func index(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	templates.ExecuteTemplate(w, "index.html", config.AuthCodeURL(""))
+// requestedWithin is how recently a badge variant must have been requested
+// for refresh to keep it up to date, and pruneAfter how long a variant
+// nobody requests keeps its saved value. Variants are whatever badge URLs
+// ask for, so without both the cron's queries would only ever grow.
+const (
+	requestedWithin = 24 * time.Hour
+	pruneAfter      = 30 * 24 * time.Hour
+)
+
+// seenKey is the memcache key marking a badge variant as recently requested.
+func seenKey(id, variant string) string {
+	return "seen:" + id + ":" + variant
+}
+
+// requested notes that a badge variant was asked for, for refresh.
+func requested(c appengine.Context, b *Badge) {
+	item := &memcache.Item{Key: seenKey(b.Id, b.Variant()), Value: []byte{}, Expiration: requestedWithin}
+	if err := memcache.Add(cache(c), item); err != nil && err != memcache.ErrNotStored {
+		c.Errorf("requested(Memcache) error: %#v", err)
+	}
 }
 
-func metric(i int) (string, string) {
-	if i > 1000000 {
-		return strconv.Itoa(i/1000000) + "M", "#4c1"
+// refresh repopulates the cached value of every badge variant which has been
+// requested lately, so visitors rarely wait on the Analytics API, and deletes
+// the saved values of those which haven't been for a long time.
+func refresh(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
-	if i > 1000 {
-		return strconv.Itoa(i/1000) + "k", "#a4a61d"
+	var properties []Property
+	keys, err := datastore.NewQuery("Property").GetAll(c, &properties)
+	if err != nil {
+		c.Errorf("refresh(Property) error: %#v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owners := make(map[string][]int)
+	for i, p := range properties {
+		owners[p.Account.Encode()] = append(owners[p.Account.Encode()], i)
+	}
+	for _, indexes := range owners {
+		ak := properties[indexes[0]].Account
+		var a Account
+		if err := datastore.Get(c, ak, &a); err != nil {
+			c.Errorf("refresh(Account) error: %#v", err)
+			continue
+		}
+		t := transport(c, &a)
+		for _, i := range indexes {
+			var values []Value
+			variants, err := datastore.NewQuery("Value").Ancestor(keys[i]).GetAll(c, &values)
+			if err != nil {
+				c.Errorf("refresh(Value) error: %#v", err)
+				continue
+			}
+			var seen []string
+			for _, vk := range variants {
+				seen = append(seen, seenKey(keys[i].StringID(), vk.StringID()))
+			}
+			wanted, err := memcache.GetMulti(cache(c), seen)
+			if err != nil {
+				c.Errorf("refresh(Memcache) error: %#v", err)
+				continue
+			}
+			var unused []*datastore.Key
+			for j, vk := range variants {
+				if _, ok := wanted[seen[j]]; !ok {
+					if time.Since(values[j].CachedAt) > pruneAfter {
+						unused = append(unused, vk)
+					}
+					continue
+				}
+				b, err := variantBadge(keys[i].StringID(), vk.StringID())
+				if err != nil {
+					c.Errorf("refresh(Variant) error: %#v", err)
+					continue
+				}
+				if b.Range == "alltime" && time.Since(values[j].CachedAt) < allTimeTTL {
+					continue
+				}
+				if _, err := revalidate(c, t, keys[i], &properties[i], b, b.Key(c)); err != nil {
+					c.Warningf("refresh(Query) property %s error: %#v", keys[i].StringID(), err)
+				}
+			}
+			if len(unused) > 0 {
+				if err := datastore.DeleteMulti(c, unused); err != nil {
+					c.Errorf("refresh(Prune) error: %#v", err)
+				}
+			}
+		}
+		saveToken(c, ak, &a, t)
 	}
-	return strconv.Itoa(i), "#e05d44"
 }
 
-func size(s string) int {
-	r := 10
-	// Values from single letter SVG font rendering width, Chrome.
-	for _, c := range s {
-		switch c {
-		case 'i':
-			r += 2
-		case ';', 'I', '\\', 'f', 'j', 'l', 'r', 't':
-			r += 4
-		case '1', '3', '5', '7', '9', ':', '?', 'E', 'F', 'J', 'P', 'T', 'Z', '[', ']', '`', 'b', 'c', 'd', 'g', 'k', 'o', 'p', 's', 'v', 'y':
-			r += 6
-		case 'K', 'L':
-			r += 7
-		case '<', '>', '@', 'G', 'O', 'W', 'm':
-			r += 10
-		default:
-			r += 8
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.FormValue("deep") != "" {
+		c := appengine.NewContext(r)
+		if _, err := datastore.NewQuery("Property").KeysOnly().Limit(1).GetAll(c, nil); err != nil {
+			c.Errorf("healthz(Datastore) error: %#v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"status": "unavailable"})
+			return
 		}
 	}
-	return r
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-func badge(w http.ResponseWriter, r *http.Request) {
+// invalidateBadge drops the cached values of one of the signed in account's
+// properties, so its badges are queried afresh on their next request.
+func invalidateBadge(w http.ResponseWriter, r *http.Request, s *Session) error {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Account.Username == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "not signed in"})
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "POST required"})
+	}
 	c := appengine.NewContext(r)
-	path := r.URL.Path[7 : len(r.URL.Path)-4]
-	total := 0
-	item, err := memcache.Get(c, "b:"+path)
-	if err == nil {
-		total, err = strconv.Atoi(string(item.Value))
-		if err != nil {
-			c.Errorf("badge(Memcache read) error: %#v", err)
-			return
+	id := r.FormValue("id")
+	if !validId.MatchString(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "no such property"})
+	}
+	var p Property
+	k := datastore.NewKey(c, "Property", id, 0, nil)
+	err := datastore.Get(c, k, &p)
+	if err == datastore.ErrNoSuchEntity || err == nil && !p.Account.Equal(s.Key(c)) {
+		w.WriteHeader(http.StatusNotFound)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "no such property"})
+	}
+	if err != nil {
+		return err
+	}
+	p.Invalidated = time.Now()
+	if _, err := datastore.Put(c, k, &p); err != nil {
+		return err
+	}
+	invalidate(c, id)
+	return json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "invalidated": true})
+}
+
+// badgeURL is the public address of a property's badge.
+func badgeURL(r *http.Request, id string) string {
+	scheme := "https"
+	if appengine.IsDevAppServer() {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host + "/badge/" + strings.Replace(url.QueryEscape(id), "%2F", "/", 1) + ".svg"
+}
+
+// snippets lists the badges of configured properties, with Markdown and HTML
+// to copy into a README or page.
+func snippets(r *http.Request, keys []*datastore.Key, properties []Property) []map[string]string {
+	var badges []map[string]string
+	for i, p := range properties {
+		if p.Profile == "" {
+			continue
 		}
-	} else {
-		k := datastore.NewKey(c, "Property", path, 0, nil)
-		var p Property
-		if err := datastore.Get(c, k, &p); err != nil {
-			c.Errorf("badge(Property) error: %#v", err)
-			return
+		u := badgeURL(r, keys[i].StringID())
+		home := u[:strings.Index(u, "/badge/")+1]
+		badges = append(badges, map[string]string{
+			"Id":       p.Id,
+			"Name":     or(p.Name, p.Id),
+			"URL":      u,
+			"Markdown": "[![analytics](" + u + ")](" + home + ")",
+			"HTML":     `<a href="` + template.HTMLEscapeString(home) + `"><img src="` + template.HTMLEscapeString(u) + `" alt="analytics"></a>`,
+		})
+	}
+	return badges
+}
+
+// listBadges describes the signed in account's configured properties as JSON,
+// with the value each default badge last showed, without querying Analytics.
+func listBadges(w http.ResponseWriter, r *http.Request, s *Session) error {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Account.Username == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "not signed in"})
+	}
+	c := appengine.NewContext(r)
+	var properties []Property
+	q := datastore.NewQuery("Property").Filter("Account =", s.Key(c))
+	keys, err := q.GetAll(c, &properties)
+	if err != nil {
+		return err
+	}
+	list := []map[string]interface{}{}
+	for i, p := range properties {
+		b := &Badge{
+			Id:      keys[i].StringID(),
+			Metrics: []string{or(p.DefaultMetric, "ga:users")},
+			Range:   or(p.DefaultRange, "7d"),
 		}
-		var a Account
-		if err := datastore.Get(c, p.Account, &a); err != nil {
-			c.Errorf("badge(Account) error: %#v", err)
-			return
+		badge := map[string]interface{}{
+			"id":          b.Id,
+			"property":    p.Id,
+			"name":        p.Name,
+			"accountName": p.AccountName,
+			"profile":     p.Profile,
+			"url":         badgeURL(r, b.Id),
+			"value":       nil,
+		}
+		var v Value
+		if _, err := memcache.Gob.Get(cache(c), b.Key(c), &v); err != nil {
+			vk := datastore.NewKey(c, "Value", b.Variant(), 0, keys[i])
+			if err := datastore.Get(c, vk, &v); err != nil && err != datastore.ErrNoSuchEntity {
+				c.Errorf("listBadges(Value) error: %#v", err)
+			}
+		}
+		if v.Cached != "" {
+			if values, err := b.parse(v.Cached); err == nil {
+				badge["value"], _ = b.message(values)
+				badge["cachedAt"] = v.CachedAt
+			}
+		}
+		list = append(list, badge)
+	}
+	return json.NewEncoder(w).Encode(list)
+}
+
+func logout(w http.ResponseWriter, r *http.Request, s *Session) error {
+	if _, err := r.Cookie("session"); err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+	setSessionCookie(w, "", -1)
+	s.Clear(appengine.NewContext(r))
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+func disconnect(w http.ResponseWriter, r *http.Request, s *Session) error {
+	if r.Method != "POST" || s.Account.Username == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+	c := appengine.NewContext(r)
+	var token string
+	if t := s.Account.GetToken(); t != nil {
+		token = or(t.RefreshToken, t.AccessToken)
+	}
+	// Local data is removed even if Google fails to revoke the token.
+	client := &http.Client{Transport: &urlfetch.Transport{Context: c}}
+	resp, err := client.Get("https://accounts.google.com/o/oauth2/revoke?token=" + url.QueryEscape(token))
+	if err != nil {
+		c.Errorf("disconnect(Revoke) error: %#v", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			c.Errorf("disconnect(Revoke) status: %v", resp.Status)
 		}
-		loaded := a
-		t := &oauth.Transport{Config: &config, Transport: &urlfetch.Transport{Context: c}}
-		t.Token = a.GetToken()
-		analytics, err := analytics.New(t.Client())
+	}
+	key := s.Key(c)
+	keys, err := datastore.NewQuery("Property").Filter("Account =", key).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if err := deleteProperties(c, keys); err != nil {
+		return err
+	}
+	if err := datastore.Delete(c, key); err != nil {
+		return err
+	}
+	s.Clear(c)
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+func index(w http.ResponseWriter, r *http.Request, s *Session) error {
+	c := appengine.NewContext(r)
+	u, err := authURL(c, r, s)
+	if err != nil {
+		return err
+	}
+	params := &struct {
+		AuthURL  string
+		Flash    string
+		SignedIn bool
+		Badges   []map[string]string
+	}{
+		AuthURL:  u,
+		Flash:    s.Flashed(c),
+		SignedIn: s.Account.Username != "",
+	}
+	if params.SignedIn {
+		var properties []Property
+		keys, err := datastore.NewQuery("Property").Filter("Account =", s.Key(c)).GetAll(c, &properties)
 		if err != nil {
-			c.Errorf("badge error: %#v", err)
-			return
+			return err
+		}
+		params.Badges = snippets(r, keys, properties)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	return respond(w, http.StatusOK, "index.html", params)
+}
+
+// authURL returns the URL to start signing in at, saving a fresh state for
+// auth to check on the way back.
+func authURL(c appengine.Context, r *http.Request, s *Session) (string, error) {
+	state, err := randomId()
+	if err != nil {
+		return "", err
+	}
+	item := &memcache.Item{
+		Key:        "state:" + s.Id,
+		Value:      []byte(state),
+		Expiration: 10 * time.Minute,
+	}
+	if err := memcache.Set(cache(c), item); err != nil {
+		return "", err
+	}
+	return redirectConfig(r).AuthCodeURL(state), nil
+}
+
+// redirectConfig is the OAuth config with the redirect URI for the request's
+// host, or the first one if none are for it. Google checks that the code
+// exchange names the same redirect URI as the sign in did.
+func redirectConfig(r *http.Request) *oauth.Config {
+	cfg := config
+	for _, uri := range redirectURIs {
+		if u, err := url.Parse(uri); err == nil && strings.EqualFold(u.Host, r.Host) {
+			cfg.RedirectURL = uri
+			break
+		}
+	}
+	return &cfg
+}
+
+// authFailed explains why signing in didn't work, with a link to try again.
+func authFailed(w http.ResponseWriter, r *http.Request, s *Session, reason string) error {
+	authFailures.inc()
+	u, err := authURL(appengine.NewContext(r), r, s)
+	if err != nil {
+		return err
+	}
+	params := &struct {
+		AuthURL string
+		Reason  string
+	}{
+		u,
+		reason,
+	}
+	w.Header().Set("Content-Type", "text/html")
+	return respond(w, http.StatusUnauthorized, "authfailed.html", params)
+}
+
+// Thresholds are the counts above which a badge turns yellow, then green.
+type Thresholds struct {
+	Yellow int
+	Green  int
+	// Invert is for metrics where less is better, like bounce rate: the badge
+	// turns yellow below Yellow, then green below Green.
+	Invert bool
+}
+
+func (t Thresholds) valid() bool {
+	if t.Invert {
+		return 0 <= t.Green && t.Green <= t.Yellow
+	}
+	return 0 <= t.Yellow && t.Yellow <= t.Green
+}
+
+// tier picks the color for a value, in whichever direction t runs, with the
+// given shade of yellow.
+func (t Thresholds) tier(f float64, yellow string) string {
+	switch {
+	case t.Invert && f < float64(t.Green), !t.Invert && f > float64(t.Green):
+		return "#4c1"
+	case t.Invert && f < float64(t.Yellow), !t.Invert && f > float64(t.Yellow):
+		return yellow
+	}
+	return "#e05d44"
+}
+
+var defaultThresholds = Thresholds{Yellow: 1000, Green: 1000000}
+
+func metric(i int, t Thresholds) (string, string) {
+	if t == (Thresholds{}) {
+		t = defaultThresholds
+	}
+	return humanize(i), t.tier(float64(i), "#a4a61d")
+}
+
+// humanize abbreviates i with a k or M suffix, keeping one decimal place
+// while there is only a single leading digit.
+func humanize(i int) string {
+	if i < 1000 {
+		return strconv.Itoa(i)
+	}
+	scale, unit := 1000, "k"
+	if i >= 999500 {
+		scale, unit = 1000000, "M"
+	}
+	if tenths := (i + scale/20) / (scale / 10); tenths < 100 {
+		return fmt.Sprintf("%d.%d%s", tenths/10, tenths%10, unit)
+	}
+	return strconv.Itoa((i+scale/2)/scale) + unit
+}
+
+// Advance widths of the printable ASCII characters, starting from ' ', in
+// 11px Verdana, the font shields.io measures badges with.
+var verdana = [...]float64{
+	3.87, 4.33, 5.05, 9.00, 6.99, 12.31, 7.99, 2.95,
+	5.00, 5.00, 6.99, 9.00, 4.00, 5.00, 4.00, 5.00,
+	6.99, 6.99, 6.99, 6.99, 6.99, 6.99, 6.99, 6.99,
+	6.99, 6.99, 5.00, 5.00, 9.00, 9.00, 9.00, 6.00,
+	11.00, 7.52, 7.54, 7.68, 8.48, 6.96, 6.32, 8.53,
+	8.27, 4.63, 5.00, 7.62, 6.12, 9.27, 8.23, 8.66,
+	6.63, 8.66, 7.65, 7.52, 6.78, 8.05, 7.52, 10.88,
+	7.54, 6.77, 7.54, 5.00, 5.00, 5.00, 9.00, 6.99,
+	6.99, 6.61, 6.85, 5.73, 6.85, 6.55, 3.87, 6.85,
+	6.96, 3.02, 3.79, 6.51, 3.02, 10.70, 6.96, 6.68,
+	6.85, 6.85, 4.69, 5.73, 4.33, 6.96, 6.51, 8.94,
+	6.51, 6.51, 5.62, 6.98, 5.00, 6.98, 9.00,
+}
+
+func size(s string) int {
+	width := 10.0
+	for _, c := range s {
+		switch {
+		case c >= ' ' && int(c-' ') < len(verdana):
+			width += verdana[c-' ']
+		case unicode.In(c, unicode.Han, unicode.Hangul, unicode.Hiragana, unicode.Katakana):
+			width += 11
+		case unicode.Is(unicode.Mn, c) || unicode.IsControl(c):
+		default:
+			width += 7
 		}
-		result, err := analytics.Data.Ga.Get("ga:"+p.Profile, "7daysAgo", "yesterday", "ga:users").Do()
+	}
+	return int(width + 0.5)
+}
+
+// Kind of metric value, which determines how it is formatted and colored.
+type Kind int
+
+const (
+	Count Kind = iota
+	Rate
+	Duration
+)
+
+type Metric struct {
+	Label string
+	Kind  Kind
+}
+
+// Metrics which can be requested with the metric parameter.
+var metrics = goals(map[string]Metric{
+	"ga:users":              {"users", Count},
+	"ga:newUsers":           {"new users", Count},
+	"ga:sessions":           {"sessions", Count},
+	"ga:pageviews":          {"pageviews", Count},
+	"ga:uniquePageviews":    {"unique views", Count},
+	"ga:bounceRate":         {"bounce rate", Rate},
+	"ga:avgSessionDuration": {"session", Duration},
+})
+
+// Analytics views have up to 20 goals, each with its own completions metric.
+const maxGoals = 20
+
+// goals adds the goal completion metrics to m: ga:goalCompletionsAll and
+// ga:goal1Completions through ga:goal20Completions.
+func goals(m map[string]Metric) map[string]Metric {
+	m["ga:goalCompletionsAll"] = Metric{"goals", Count}
+	for i := 1; i <= maxGoals; i++ {
+		m["ga:goal"+strconv.Itoa(i)+"Completions"] = Metric{"goal " + strconv.Itoa(i), Count}
+	}
+	return m
+}
+
+// Counts above which goal completions turn yellow, then green, unless the
+// badge or property sets its own. Goals are rarely in the thousands.
+var goalThresholds = Thresholds{Yellow: 10, Green: 100}
+
+// Rates turn yellow below 60%, then green below 40%, unless the property has
+// inverted thresholds of its own. Those set before Invert existed were meant
+// for counts, so plain ones are left to counts.
+var rateThresholds = Thresholds{Yellow: 60, Green: 40, Invert: true}
+
+// thresholds returns the color tiers for a metric, preferring those
+// configured for the badge.
+func thresholds(m string, t Thresholds) Thresholds {
+	switch {
+	case metrics[m].Kind == Rate && !t.Invert:
+		return rateThresholds
+	case t == (Thresholds{}) && strings.HasPrefix(m, "ga:goal"):
+		return goalThresholds
+	}
+	return t
+}
+
+// format renders a raw Analytics value for the badge, with a color suiting
+// its kind: more is better for counts and durations, less for rates, unless
+// the thresholds are inverted.
+func format(m, raw string, t Thresholds) (string, string, error) {
+	switch metrics[m].Kind {
+	case Rate:
+		f, err := strconv.ParseFloat(raw, 64)
 		if err != nil {
-			c.Errorf("badge(Data) error: %#v", err)
-			return
+			return "", "", err
 		}
-		total, err = strconv.Atoi(result.TotalsForAllResults["ga:users"])
+		return strconv.FormatFloat(f, 'f', 1, 64) + "%", thresholds(m, t).tier(f, "#dfb317"), nil
+	case Duration:
+		f, err := strconv.ParseFloat(raw, 64)
 		if err != nil {
-			c.Errorf("badge(Total) error: %#v", err)
-			return
+			return "", "", err
 		}
-		item := &memcache.Item{
-			Key:        "b:" + path,
-			Value:      []byte(strconv.Itoa(total)),
-			Expiration: time.Hour * 12,
+		seconds := int(f + 0.5)
+		color := "#e05d44"
+		if seconds >= 120 {
+			color = "#4c1"
+		} else if seconds >= 30 {
+			color = "#dfb317"
+		}
+		if seconds < 60 {
+			return strconv.Itoa(seconds) + "s", color, nil
+		}
+		return strconv.Itoa(seconds/60) + "m" + strconv.Itoa(seconds%60) + "s", color, nil
+	}
+	i, err := strconv.Atoi(raw)
+	if err != nil {
+		return "", "", err
+	}
+	number, color := metric(i, thresholds(m, t))
+	return number, color, nil
+}
+
+type Range struct {
+	Start  string
+	End    string
+	Suffix string
+
+	// The equally long window just before, which trends compare against.
+	PreviousStart string
+	PreviousEnd   string
+}
+
+// previous returns the window before r.
+func (r Range) previous() Range {
+	return Range{Start: r.PreviousStart, End: r.PreviousEnd, Suffix: r.Suffix}
+}
+
+// Date ranges which can be requested with the range parameter.
+var ranges = map[string]Range{
+	"today":  {"today", "today", "/today", "yesterday", "yesterday"},
+	"1d":     {"yesterday", "yesterday", "/day", "2daysAgo", "2daysAgo"},
+	"7d":     {"7daysAgo", "yesterday", "/week", "14daysAgo", "8daysAgo"},
+	"30d":    {"30daysAgo", "yesterday", "/month", "60daysAgo", "31daysAgo"},
+	"1month": {"30daysAgo", "yesterday", "/month", "60daysAgo", "31daysAgo"},
+	"90d":    {"90daysAgo", "yesterday", "/quarter", "180daysAgo", "91daysAgo"},
+	"1year":  {"365daysAgo", "yesterday", "/year", "730daysAgo", "366daysAgo"},
+	// All time has no window before it, so trend badges can't use it.
+	"alltime": {allTimeStart, "yesterday", " total", "", ""},
+}
+
+// allTimeStart is the earliest date the Core Reporting API has data for.
+const allTimeStart = "2005-01-01"
+
+// All time values are expensive to query and barely change in a day, so
+// they're kept at least this long, whatever the property's TTL.
+const allTimeTTL = 24 * time.Hour
+
+// cache returns the context for memcache calls, in the configured namespace.
+func cache(c appengine.Context) appengine.Context {
+	if namespace == "" {
+		return c
+	}
+	nc, err := appengine.Namespace(c, namespace)
+	if err != nil {
+		c.Errorf("cache(Namespace) error: %#v", err)
+		return c
+	}
+	return nc
+}
+
+// generation returns a counter included in every memcache key for a property,
+// since the possible badge variants are too many to delete individually.
+func generation(c appengine.Context, id string) string {
+	g, err := memcache.Increment(cache(c), "g:"+id, 0, uint64(time.Now().Unix()))
+	if err != nil {
+		c.Errorf("generation(Memcache) error: %#v", err)
+	}
+	return strconv.FormatUint(g, 36)
+}
+
+// invalidate bumps the generation of each property, orphaning its cached values.
+func invalidate(c appengine.Context, ids ...string) {
+	for _, id := range ids {
+		if _, err := memcache.Increment(cache(c), "g:"+id, 1, uint64(time.Now().Unix())); err != nil {
+			c.Errorf("invalidate(Memcache) error: %#v", err)
 		}
-		if err := memcache.Set(c, item); err != nil {
-			c.Errorf("badge(Memcache) error: %#v", err)
+	}
+}
+
+// Badge styles, mirroring those offered by shields.io.
+var styles = map[string]string{
+	"flat":        "badge-flat.svg",
+	"flat-square": "badge-flat-square.svg",
+	"plastic":     "badge-plastic.svg",
+}
+
+// sanitize strips control characters and truncates user supplied badge text.
+// Escaping is left to html/template, which also produces valid XML entities.
+func sanitize(s string) string {
+	var runes []rune
+	for _, c := range s {
+		if unicode.IsControl(c) {
+			continue
 		}
-		a.SetToken(t.Token)
-		if a != loaded {
-			_, err = datastore.Put(c, p.Account, &a)
+		runes = append(runes, c)
+		if len(runes) == 40 {
+			break
 		}
 	}
-	number, color := metric(total)
-	params := &struct {
-		Color       string
-		Left        string
-		Right       string
-		LeftWidth   int
-		RightWidth  int
-		LeftCenter  int
-		RightCenter int
-		Total       int
-	}{
-		Left:  "users",
-		Right: number + "/week",
-		Color: color,
-	}
-	params.LeftWidth = size(params.Left)
-	params.RightWidth = size(params.Right)
-	params.Total = params.LeftWidth + params.RightWidth
-	params.LeftCenter = params.LeftWidth/2 + 1
-	params.RightCenter = params.LeftWidth + params.RightWidth/2 - 1
-	w.Header().Set("Content-Type", "image/svg+xml")
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-	templates.ExecuteTemplate(w, "badge.svg", params)
+	return strings.TrimSpace(string(runes))
+}
+
+// Logos which can be shown left of the label with the logo parameter.
+var logos = map[string]template.URL{
+	"chart":           "data:image/svg+xml;base64,PHN2ZyB4bWxucz0iaHR0cDovL3d3dy53My5vcmcvMjAwMC9zdmciIHZpZXdCb3g9IjAgMCAxNCAxNCI+PHBhdGggZD0iTTEgMTJsNC01IDMgMyA1LTciIGZpbGw9Im5vbmUiIHN0cm9rZT0iI2ZmZiIgc3Ryb2tlLXdpZHRoPSIyIiBzdHJva2UtbGluZWNhcD0icm91bmQiIHN0cm9rZS1saW5lam9pbj0icm91bmQiLz48L3N2Zz4=",
+	"eye":             "data:image/svg+xml;base64,PHN2ZyB4bWxucz0iaHR0cDovL3d3dy53My5vcmcvMjAwMC9zdmciIHZpZXdCb3g9IjAgMCAxNCAxNCI+PHBhdGggZD0iTTEgN3MyLjUtNC41IDYtNC41UzEzIDcgMTMgN3MtMi41IDQuNS02IDQuNVMxIDcgMSA3eiIgZmlsbD0ibm9uZSIgc3Ryb2tlPSIjZmZmIiBzdHJva2Utd2lkdGg9IjEuNSIvPjxjaXJjbGUgY3g9IjciIGN5PSI3IiByPSIyIiBmaWxsPSIjZmZmIi8+PC9zdmc+",
+	"googleanalytics": "data:image/svg+xml;base64,PHN2ZyB4bWxucz0iaHR0cDovL3d3dy53My5vcmcvMjAwMC9zdmciIHZpZXdCb3g9IjAgMCAxNCAxNCI+PHJlY3QgeD0iMSIgeT0iOCIgd2lkdGg9IjMiIGhlaWdodD0iNSIgcng9IjEuNSIgZmlsbD0iI2ZmZiIvPjxyZWN0IHg9IjUuNSIgeT0iNC41IiB3aWR0aD0iMyIgaGVpZ2h0PSI4LjUiIHJ4PSIxLjUiIGZpbGw9IiNmZmYiLz48cmVjdCB4PSIxMCIgeT0iMSIgd2lkdGg9IjMiIGhlaWdodD0iMTIiIHJ4PSIxLjUiIGZpbGw9IiNmZmYiLz48L3N2Zz4=",
+	"users":           "data:image/svg+xml;base64,PHN2ZyB4bWxucz0iaHR0cDovL3d3dy53My5vcmcvMjAwMC9zdmciIHZpZXdCb3g9IjAgMCAxNCAxNCI+PGNpcmNsZSBjeD0iNyIgY3k9IjQiIHI9IjMiIGZpbGw9IiNmZmYiLz48cGF0aCBkPSJNMSAxM2MwLTMuMyAyLjctNSA2LTVzNiAxLjcgNiA1eiIgZmlsbD0iI2ZmZiIvPjwvc3ZnPg==",
+}
+
+// BadgeParams are the values a badge template is executed with. The widths
+// and centers are computed by render, and a zero Status means 200.
+type BadgeParams struct {
+	Status      int
+	Style       string
+	Logo        template.URL
+	Color       string
+	Left        string
+	Right       string
+	LogoWidth   int
+	LeftWidth   int
+	RightWidth  int
+	LeftCenter  int
+	RightCenter int
+	Total       int
+	Scale       int
+	// Radius overrides the style's corner radius when not empty.
+	Radius     string
+	NoGradient bool
+	Theme      string
+	// Title is shown when hovering over the badge.
+	Title string
+	// MinWidth pads narrower badges out to this width, in badge units.
+	MinWidth int
+}
+
+// Stylesheets recoloring the label side for dark pages, by theme parameter.
+var themes = map[string]template.CSS{
+	"dark": ".label{fill:#e5e5e5}.label-text{fill:#333}.label-shadow{fill:#fff}",
+	"auto": "@media (prefers-color-scheme: dark){.label{fill:#e5e5e5}.label-text{fill:#333}.label-shadow{fill:#fff}}",
+}
+
+// ThemeCSS is the stylesheet for the badge's theme, if any.
+func (p BadgeParams) ThemeCSS() template.CSS {
+	return themes[p.Theme]
+}
+
+// appearance reads the parameters controlling how any badge is drawn.
+func appearance(r *http.Request) BadgeParams {
+	p := BadgeParams{
+		Style:      r.FormValue("style"),
+		Logo:       logos[r.FormValue("logo")],
+		Scale:      scale(r),
+		Radius:     radius(r),
+		NoGradient: r.FormValue("flat") != "",
+		Theme:      r.FormValue("theme"),
+		MinWidth:   minWidth(r),
+	}
+	if _, ok := styles[p.Style]; !ok {
+		p.Style = "flat"
+	}
+	if _, ok := themes[p.Theme]; !ok {
+		p.Theme = ""
+	}
+	return p
+}
+
+// layout works out the widths and text positions of an SVG badge.
+func (p *BadgeParams) layout() {
+	if p.Scale == 0 {
+		p.Scale = 1
+	}
+	if p.Logo != "" {
+		p.LogoWidth = 17
+	}
+	p.LeftWidth = size(p.Left) + p.LogoWidth
+	p.RightWidth = size(p.Right)
+	if extra := p.MinWidth - p.LeftWidth - p.RightWidth; extra > 0 {
+		p.LeftWidth += extra / 2
+		p.RightWidth += extra - extra/2
+	}
+	p.Total = p.LeftWidth + p.RightWidth
+	p.LeftCenter = p.LogoWidth + (p.LeftWidth-p.LogoWidth)/2 + 1
+	p.RightCenter = p.LeftWidth + p.RightWidth/2 - 1
+}
+
+// Scaled multiplies a length in badge units by the requested scale, for the
+// outer size of an SVG badge, which is drawn in unscaled units in its viewBox.
+func (p BadgeParams) Scaled(n int) int {
+	return n * p.Scale
+}
+
+// radius parses the radius parameter, a corner radius from 0 to 10.
+func radius(r *http.Request) string {
+	if n, err := strconv.Atoi(r.FormValue("radius")); err == nil && n >= 0 && n <= 10 {
+		return strconv.Itoa(n)
+	}
+	return ""
+}
+
+// minWidth parses the minwidth parameter, up to 500 badge units.
+func minWidth(r *http.Request) int {
+	if n, err := strconv.Atoi(r.FormValue("minwidth")); err == nil && n > 0 && n <= 500 {
+		return n
+	}
+	return 0
+}
+
+// cacheSeconds parses the cacheSeconds parameter, which works as it does on
+// shields.io, overriding how long a badge may be cached. It's kept within 5
+// minutes and a day, since shorter only adds load and can't fetch any sooner.
+func cacheSeconds(r *http.Request) int {
+	n, err := strconv.Atoi(r.FormValue("cacheSeconds"))
+	switch {
+	case err != nil || n <= 0:
+		return 0
+	case n < 300:
+		return 300
+	case n > 86400:
+		return 86400
+	}
+	return n
+}
+
+// scale parses the scale parameter, which enlarges SVG badges up to 3x.
+func scale(r *http.Request) int {
+	if n, err := strconv.Atoi(r.FormValue("scale")); err == nil && n >= 1 && n <= 3 {
+		return n
+	}
+	return 1
+}
+
+// hash identifies everything a badge is drawn from, for ETags and caching.
+func (p BadgeParams) hash() string {
+	sum := sha1.Sum([]byte(strings.Join([]string{p.Style, string(p.Logo), p.Left, p.Right, p.Color, strconv.Itoa(p.Scale), p.Radius, strconv.FormatBool(p.NoGradient), p.Theme, p.Title, strconv.Itoa(p.MinWidth)}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// errorStatus is the status a badge which couldn't be fetched is served with,
+// so monitoring and caches can tell it from a working one. Errors from
+// Analytics itself are a bad gateway, and anything else is a bug.
+func errorStatus(err error) int {
+	switch err {
+	case errNotFound:
+		return http.StatusNotFound
+	case errRateLimited, errUnavailable:
+		return http.StatusServiceUnavailable
+	case errAuthExpired:
+		return http.StatusBadGateway
+	case errEmbedded:
+		return http.StatusForbidden
+	case errProfile, errAggregate, errGA4Metric, errGA4Filters, errSparklineGA4, errSplitGA4, errTopGA4:
+		return http.StatusBadRequest
+	}
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return http.StatusBadGateway
+	case *heldError:
+		return e.status
+	}
+	return http.StatusInternalServerError
+}
+
+func errorParams(status int, message string) BadgeParams {
+	return BadgeParams{Status: status, Style: "flat", Left: "badge", Right: message, Color: "#9f9f9f"}
+}
+
+// cacheFor sets how long a badge served with status may be cached, unless its
+// handler already decided. Errors are only kept for a minute, so caches pick
+// up a fixed badge soon after.
+func cacheFor(w http.ResponseWriter, status int) {
+	switch {
+	case w.Header().Get("Cache-Control") != "":
+	case status >= 300:
+		w.Header().Set("Cache-Control", "public, max-age=60")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+}
+
+func errorBadge(w http.ResponseWriter, r *http.Request, status int, message string) {
+	render(w, r, errorParams(status, message))
+}
+
+// render draws a badge as SVG, or as PNG when the request path asks for one.
+// Logos and scaling only apply to SVG badges.
+func render(w http.ResponseWriter, r *http.Request, params BadgeParams) {
+	if params.Scale == 0 {
+		params.Scale = 1
+	}
+	png := strings.HasSuffix(r.URL.Path, ".png")
+	gz := !png && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	hash := params.hash()
+	etag := `"` + hash + `"`
+	if png {
+		etag = `"png-` + hash + `"`
+	} else if gz {
+		etag = `"gz-` + hash + `"`
+	}
+	// Query parameters are part of the URL caches key on, and the hash,
+	// so only the request headers a badge depends on need to be listed.
+	if !png {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	// Not modified responses need the caching headers too, or caches which
+	// revalidate would forget how long the badge may be kept.
+	cacheFor(w, params.Status)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if png {
+		c := appengine.NewContext(r)
+		// PNG bytes are cached by content, since rasterizing isn't free.
+		key := "png:" + hash
+		var body []byte
+		if item, err := memcache.Get(cache(c), key); err == nil {
+			body = item.Value
+		} else {
+			body, err = renderPNG(params.Left, params.Right, params.Color)
+			if err != nil {
+				c.Errorf("renderPNG error: %#v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			item := &memcache.Item{
+				Key:        key,
+				Value:      body,
+				Expiration: time.Hour * 12,
+			}
+			if err := memcache.Set(cache(c), item); err != nil {
+				c.Errorf("render(Memcache) error: %#v", err)
+			}
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if params.Status != 0 {
+			w.WriteHeader(params.Status)
+		}
+		w.Write(body)
+		return
+	}
+	var body []byte
+	if gz {
+		c := appengine.NewContext(r)
+		// Compressed SVG is cached by content too, to save recompressing.
+		key := "svgz:" + hash
+		if item, err := memcache.Get(cache(c), key); err == nil {
+			body = item.Value
+		} else {
+			var compressed bytes.Buffer
+			zw := gzip.NewWriter(&compressed)
+			if err := svg(zw, params); err != nil {
+				c.Errorf("render(SVG) error: %#v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			zw.Close()
+			body = compressed.Bytes()
+			item := &memcache.Item{
+				Key:        key,
+				Value:      body,
+				Expiration: time.Hour * 12,
+			}
+			if err := memcache.Set(cache(c), item); err != nil {
+				c.Errorf("render(Memcache) error: %#v", err)
+			}
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+	} else {
+		var err error
+		if body, err = params.Render(); err != nil {
+			appengine.NewContext(r).Errorf("render(SVG) error: %#v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if params.Status != 0 {
+		w.WriteHeader(params.Status)
+	}
+	w.Write(body)
+}
+
+// respond renders a template in full before sending any of it, so a template
+// error becomes an error response rather than a truncated page.
+func respond(w http.ResponseWriter, status int, name string, data interface{}) error {
+	var b bytes.Buffer
+	if err := templates.ExecuteTemplate(&b, name, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+	return nil
+}
+
+// svg lays out and draws a badge in its style's template.
+func svg(w io.Writer, params BadgeParams) error {
+	params.layout()
+	return templates.ExecuteTemplate(w, styles[params.Style], params)
+}
+
+// Render returns the SVG for a badge.
+func (p BadgeParams) Render() ([]byte, error) {
+	var b bytes.Buffer
+	if err := svg(&b, p); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// RenderBadge returns the SVG for a flat badge with the given texts, in a
+// color name or hex value as accepted by the color parameter.
+func RenderBadge(left, right, color string) ([]byte, error) {
+	hex := parseColor(color)
+	if hex == "" {
+		return nil, fmt.Errorf("invalid color %q", color)
+	}
+	return BadgeParams{Style: "flat", Left: left, Right: right, Color: hex}.Render()
+}
+
+// Named colors accepted by the color parameter, as used by shields.io.
+var colors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellowgreen": "#a4a61d",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"lightgrey":   "#9f9f9f",
+}
+
+var hexColor = regexp.MustCompile("^([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$")
+
+// parseColor returns the color for a name or hex value, or "" if invalid.
+func parseColor(s string) string {
+	if color, ok := colors[s]; ok {
+		return color
+	}
+	s = strings.TrimPrefix(s, "#")
+	if hexColor.MatchString(s) {
+		return "#" + s
+	}
+	return ""
+}
+
+type Badge struct {
+	Id         string
+	Metrics    []string
+	Range      string
+	Realtime   bool
+	Trend      bool
+	Profile    string
+	Label      string
+	Color      string
+	Thresholds Thresholds
+	// Suffix replaces the range suffix, before the values if SuffixLeft.
+	Suffix     string
+	SuffixLeft bool
+	// Filters restricts the data to matching sessions, in Analytics syntax.
+	Filters string
+	// Lang is the language of the default texts, or "" for English.
+	Lang string
+	// Target shows the count as a percentage of it, if set.
+	Target int
+}
+
+// Variant identifies the data shown by a badge, independent of how it's drawn.
+func (b *Badge) Variant() string {
+	variant := strings.Join(b.sorted(), ",") + ":" + b.Range + ":" + b.Profile
+	if b.Filters != "" {
+		// Escaped so the filter's own colons don't split the variant.
+		variant += ":filters=" + url.QueryEscape(b.Filters)
+	}
+	if b.Trend {
+		variant += ":trend"
+	}
+	return variant
+}
+
+// variantBadge rebuilds the data fields of a badge from its Variant.
+func variantBadge(id, variant string) (*Badge, error) {
+	// Metric names contain colons too, so split from the right.
+	parts := strings.Split(variant, ":")
+	trend := parts[len(parts)-1] == "trend"
+	if trend {
+		parts = parts[:len(parts)-1]
+	}
+	filters := ""
+	if last := parts[len(parts)-1]; strings.HasPrefix(last, "filters=") {
+		var err error
+		if filters, err = url.QueryUnescape(strings.TrimPrefix(last, "filters=")); err != nil {
+			return nil, err
+		}
+		parts = parts[:len(parts)-1]
+	}
+	n := len(parts)
+	if n < 4 {
+		return nil, fmt.Errorf("malformed variant %q", variant)
+	}
+	return &Badge{
+		Id:      id,
+		Metrics: strings.Split(strings.Join(parts[:n-2], ":"), ","),
+		Range:   parts[n-2],
+		Trend:   trend,
+		Profile: parts[n-1],
+		Filters: filters,
+	}, nil
+}
+
+// Key returns the memcache key for the badge's values, which are stored in
+// sorted metric order.
+func (b *Badge) Key(c appengine.Context) string {
+	if b.Realtime {
+		return "rt:" + b.Id + ":" + generation(c, b.Id) + ":" + b.Profile
+	}
+	return "b:" + b.Id + ":" + generation(c, b.Id) + ":" + b.Variant()
+}
+
+// parse reads comma separated raw values in sorted metric order.
+func (b *Badge) parse(value string) ([]string, error) {
+	sorted := b.sorted()
+	values := strings.Split(value, ",")
+	if len(values) != len(sorted) {
+		return nil, fmt.Errorf("malformed value %q", value)
+	}
+	raw := make(map[string]string)
+	for i, m := range sorted {
+		raw[m] = values[i]
+	}
+	return b.order(raw), nil
+}
+
+// unpack parses a cached value's current and previous values.
+func (b *Badge) unpack(v *Value) (err error) {
+	if v.Values, err = b.parse(v.Cached); err != nil {
+		return err
+	}
+	if v.Previous != "" {
+		v.PreviousValues, err = b.parse(v.Previous)
+	}
+	return err
+}
+
+func (b *Badge) sorted() []string {
+	sorted := append([]string(nil), b.Metrics...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func parseBadge(r *http.Request, id string, p *Property) (*Badge, error) {
+	b := &Badge{
+		Id:         id,
+		Range:      or(r.FormValue("range"), p.DefaultRange),
+		Profile:    r.FormValue("profile"),
+		Color:      parseColor(r.FormValue("color")),
+		Thresholds: p.Thresholds,
+		Lang:       language(r),
+	}
+	if r.FormValue("mode") == "realtime" {
+		b.Realtime = true
+		b.Metrics = []string{"rt:activeUsers"}
+		b.Label = sanitize(r.FormValue("label"))
+		if b.Label == "" {
+			b.Label = b.translate("users")
+		}
+		return b, nil
+	}
+	b.Trend = r.FormValue("trend") != ""
+	b.Suffix = sanitize(r.FormValue("suffix"))
+	b.SuffixLeft = r.FormValue("suffixpos") == "left"
+	b.Filters = r.FormValue("filters")
+	if b.Filters != "" && !validFilters(b.Filters) {
+		return nil, errors.New("invalid filters")
+	}
+	if list := r.FormValue("metrics"); list != "" {
+		b.Metrics = strings.Split(list, ",")
+	} else if m := or(r.FormValue("metric"), p.DefaultMetric); m != "" {
+		b.Metrics = []string{m}
+	} else {
+		b.Metrics = []string{"ga:users"}
+	}
+	if len(b.Metrics) > 4 {
+		return nil, errors.New("too many metrics")
+	}
+	var labels []string
+	for _, m := range b.Metrics {
+		metric, ok := metrics[m]
+		if !ok {
+			return nil, errors.New("invalid metric")
+		}
+		labels = append(labels, b.translate(metric.Label))
+	}
+	b.Label = sanitize(r.FormValue("label"))
+	if b.Label == "" {
+		b.Label = strings.Join(labels, " / ")
+	}
+	if b.Range == "" {
+		b.Range = "7d"
+	}
+	if _, ok := ranges[b.Range]; !ok {
+		return nil, errors.New("invalid range")
+	}
+	if b.Trend && ranges[b.Range].PreviousStart == "" {
+		return nil, errors.New("no trend for all time")
+	}
+	b.Target = p.Target
+	if target := r.FormValue("target"); target != "" {
+		n, err := strconv.Atoi(target)
+		if err != nil || n <= 0 {
+			return nil, errors.New("invalid target")
+		}
+		b.Target = n
+	}
+	if b.Target > 0 && (len(b.Metrics) != 1 || metrics[b.Metrics[0]].Kind != Count) {
+		if r.FormValue("target") != "" {
+			return nil, errors.New("target needs one count metric")
+		}
+		b.Target = 0
+	}
+	return b, nil
+}
+
+var validFilter = regexp.MustCompile(`^ga:\w+(==|!=|>=|<=|>|<|=~|!~|=@|!@)[^,;\\\x00-\x1f]+$`)
+
+// validFilters reports whether filters are conditions on Analytics dimensions
+// or metrics joined by , (or) and ; (and). Escaped separators aren't allowed.
+func validFilters(filters string) bool {
+	if len(filters) > 256 {
+		return false
+	}
+	for _, and := range strings.Split(filters, ";") {
+		for _, condition := range strings.Split(and, ",") {
+			if !validFilter.MatchString(condition) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// or returns the first of values which is not empty.
+func or(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// defaults returns the stored settings for a property, which fill in badge
+// parameters left out of the URL. Missing properties yield empty defaults.
+func defaults(c appengine.Context, id string) *Property {
+	p := &Property{}
+	if id == "agg" {
+		return p
+	}
+	key := "p:" + id + ":" + generation(c, id)
+	if _, err := memcache.Gob.Get(cache(c), key, p); err == nil {
+		return p
+	}
+	k := datastore.NewKey(c, "Property", id, 0, nil)
+	if err := datastore.Get(c, k, p); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			c.Errorf("defaults(Property) error: %#v", err)
+		}
+		return &Property{}
+	}
+	if err := memcache.Gob.Set(cache(c), &memcache.Item{Key: key, Object: p, Expiration: time.Hour}); err != nil {
+		c.Errorf("defaults(Memcache) error: %#v", err)
+	}
+	return p
+}
+
+var (
+	errAuthExpired = errors.New("auth expired")
+	errNotFound    = errors.New("not found")
+	errRateLimited = errors.New("rate limited")
+	errUnavailable = errors.New("temporarily unavailable")
+)
+
+// rateLimited reports whether an Analytics API error is due to quota.
+func rateLimited(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if e.Code == http.StatusTooManyRequests {
+		return true
+	}
+	for _, item := range e.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded", "dailyLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// badgeErrors are the errors a query can fail with which callers tell apart,
+// so failed can hand back the same value for the hold off.
+var badgeErrors = []error{errAuthExpired, errNotFound, errRateLimited, errUnavailable, errProfile, errAggregate, errGA4Metric, errGA4Filters, errSparklineGA4, errSplitGA4, errTopGA4}
+
+// heldError is any other error failed returns, keeping the status it was
+// served with when it first happened.
+type heldError struct {
+	status  int
+	message string
+}
+
+func (e *heldError) Error() string {
+	return e.message
+}
+
+// failed returns the error of a recent failed query for the badge key,
+// or nil if Analytics may be asked again.
+func failed(c appengine.Context, key string) error {
+	item, err := memcache.Get(cache(c), "fail:"+key)
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(string(item.Value), " ", 2)
+	status, err := strconv.Atoi(parts[0])
+	if len(parts) != 2 || err != nil {
+		return &heldError{http.StatusInternalServerError, string(item.Value)}
+	}
+	for _, e := range badgeErrors {
+		if e.Error() == parts[1] {
+			return e
+		}
+	}
+	return &heldError{status, parts[1]}
+}
+
+// flight is a query in progress, which other requests for the same badge wait
+// on instead of making their own.
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+var (
+	flights      = make(map[string]*flight)
+	flightsMutex sync.Mutex
+)
+
+// shared calls fn, unless a call for the same key is already in progress, in
+// which case it waits for and returns that call's result. Instances don't
+// share memory, so concurrent requests served by different instances still
+// each make their own query.
+func shared(key string, fn func() (interface{}, error)) (interface{}, error) {
+	flightsMutex.Lock()
+	if f, ok := flights[key]; ok {
+		flightsMutex.Unlock()
+		<-f.done
+		return f.value, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	flights[key] = f
+	flightsMutex.Unlock()
+	defer func() {
+		flightsMutex.Lock()
+		delete(flights, key)
+		flightsMutex.Unlock()
+		close(f.done)
+	}()
+	f.value, f.err = fn()
+	return f.value, f.err
+}
+
+// load returns a property along with the account which configured it.
+func load(c appengine.Context, id string) (*datastore.Key, *Property, *Account, error) {
+	k := datastore.NewKey(c, "Property", id, 0, nil)
+	var p Property
+	if err := datastore.Get(c, k, &p); err != nil {
+		c.Errorf("load(Property) error: %#v", err)
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil, nil, errNotFound
+		}
+		return nil, nil, nil, errUnavailable
+	}
+	var a Account
+	if err := datastore.Get(c, p.Account, &a); err != nil {
+		c.Errorf("load(Account) error: %#v", err)
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil, nil, errNotFound
+		}
+		return nil, nil, nil, errUnavailable
+	}
+	return k, &p, &a, nil
+}
+
+// fetch returns the raw metric values for a badge, from memcache if possible.
+func fetch(c appengine.Context, b *Badge) (*Value, error) {
+	if !b.Realtime {
+		requested(c, b)
+	}
+	key := b.Key(c)
+	var cached Value
+	if _, err := memcache.Gob.Get(cache(c), key, &cached); err == nil {
+		if err = b.unpack(&cached); err == nil {
+			cacheHits.inc()
+			return &cached, nil
+		}
+		c.Errorf("fetch(Memcache read) error: %#v", err)
+	} else if err != memcache.ErrCacheMiss {
+		// Carry on to Analytics, which still works without memcache.
+		c.Errorf("fetch(Memcache) error: %#v", err)
+	}
+	cacheMisses.inc()
+	k, p, a, err := load(c, b.Id)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := p.profile(b)
+	if err != nil {
+		return nil, err
+	}
+	vk := datastore.NewKey(c, "Value", b.Variant(), 0, k)
+	var stale Value
+	saved := !b.Realtime && datastore.Get(c, vk, &stale) == nil && stale.Profile == profile && b.unpack(&stale) == nil
+	if saved && time.Since(stale.CachedAt) < 48*time.Hour && stale.CachedAt.After(p.Invalidated) {
+		// Answer with the saved value straight away, and let a task bring it
+		// up to date for the next request.
+		revalidateLater(c, b, key)
+		return &stale, nil
+	}
+	t := transport(c, a)
+	defer saveToken(c, p.Account, a, t)
+	v, err := revalidate(c, t, k, p, b, key)
+	if err == errRateLimited && saved {
+		// Any saved value beats nothing while the quota is exhausted.
+		return &stale, nil
+	}
+	return v, err
+}
+
+// revalidate queries a badge's values unless they failed recently or the
+// property is over its hourly limit.
+func revalidate(c appengine.Context, t *oauth.Transport, k *datastore.Key, p *Property, b *Badge, key string) (*Value, error) {
+	err := failed(c, key)
+	if err == nil && !p.allow(c) {
+		c.Warningf("revalidate(Limit) property %s exceeded %d queries an hour", p.Id, p.limit())
+		err = errRateLimited
+	}
+	if err != nil {
+		return nil, err
+	}
+	v, err := shared(key, func() (interface{}, error) {
+		v, err := query(c, t, k, p, b)
+		if err != nil {
+			holdOff(c, key, err)
+		}
+		return v, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Value), nil
+}
+
+// holdOff keeps requests for a key away from Analytics for a while after err,
+// so a broken badge which is requested often doesn't burn through the daily
+// quota. failed returns err until then.
+func holdOff(c appengine.Context, key string, err error) {
+	value := strconv.Itoa(errorStatus(err)) + " " + err.Error()
+	item := &memcache.Item{Key: "fail:" + key, Value: []byte(value), Expiration: 5 * time.Minute}
+	if err := memcache.Set(cache(c), item); err != nil {
+		c.Errorf("holdOff(Memcache) error: %#v", err)
+	}
+}
+
+// gaGet makes a Core Reporting API call for one of a property's badges which
+// aren't plain totals, like sparklines. Like revalidate it holds off after
+// failures, shares concurrent calls for the same key and counts against the
+// hourly limit. The last good result is kept for two days, and returned
+// instead of errors other than expired authorization.
+func gaGet(c appengine.Context, key string, p *Property, a *Account, call func(*analytics.Service) (*analytics.GaData, error)) (*analytics.GaData, error) {
+	var last analytics.GaData
+	_, lastErr := memcache.Gob.Get(cache(c), "last:"+key, &last)
+	fallback := func(err error) (*analytics.GaData, error) {
+		if lastErr == nil && err != errAuthExpired {
+			return &last, nil
+		}
+		return nil, err
+	}
+	err := failed(c, key)
+	if err == nil && !p.allow(c) {
+		c.Warningf("gaGet(Limit) property %s exceeded %d queries an hour", p.Id, p.limit())
+		err = errRateLimited
+	}
+	if err != nil {
+		return fallback(err)
+	}
+	result, err := shared(key, func() (interface{}, error) {
+		t := transport(c, a)
+		defer saveToken(c, p.Account, a, t)
+		do := func() (*analytics.GaData, error) {
+			p.used(c)
+			service, err := analytics.New(t.Client())
+			if err != nil {
+				return nil, err
+			}
+			return call(service)
+		}
+		result, err := do()
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusUnauthorized {
+			if err := t.Refresh(); err != nil {
+				c.Errorf("gaGet(Refresh) error: %#v", err)
+				holdOff(c, key, errAuthExpired)
+				return nil, errAuthExpired
+			}
+			result, err = do()
+		}
+		if err != nil {
+			gaErrors.inc()
+		}
+		if rateLimited(err) {
+			c.Warningf("gaGet(Data) rate limited: %#v", err)
+			err = errRateLimited
+		} else if err != nil {
+			c.Errorf("gaGet(Data) error: %#v", err)
+		}
+		if err != nil {
+			holdOff(c, key, err)
+			return nil, err
+		}
+		// Only what callers read is kept, which is all Gob can be sure of.
+		item := &memcache.Item{
+			Key:        "last:" + key,
+			Object:     &analytics.GaData{Rows: result.Rows, TotalsForAllResults: result.TotalsForAllResults},
+			Expiration: 48 * time.Hour,
+		}
+		if err := memcache.Gob.Set(cache(c), item); err != nil {
+			c.Errorf("gaGet(Memcache) error: %#v", err)
+		}
+		return result, nil
+	})
+	if err != nil {
+		return fallback(err)
+	}
+	return result.(*analytics.GaData), nil
+}
+
+// revalidateLater queues a task to query a badge served from its saved
+// value, unless one was queued in the last few minutes.
+func revalidateLater(c appengine.Context, b *Badge, key string) {
+	item := &memcache.Item{Key: "queued:" + key, Value: []byte{}, Expiration: 5 * time.Minute}
+	if err := memcache.Add(cache(c), item); err == memcache.ErrNotStored {
+		return
+	} else if err != nil {
+		c.Errorf("revalidateLater(Memcache) error: %#v", err)
+	}
+	task := taskqueue.NewPOSTTask("/tasks/revalidate", url.Values{"id": {b.Id}, "variant": {b.Variant()}})
+	if _, err := taskqueue.Add(c, task, ""); err != nil {
+		c.Errorf("revalidateLater(Task) error: %#v", err)
+	}
+}
+
+// revalidateTask refreshes one badge variant queued by revalidateLater.
+// Failures are logged rather than retried, since the badge still has its
+// saved value and the next request after the hold off queues another.
+func revalidateTask(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Queuename") == "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id := r.FormValue("id")
+	b, err := variantBadge(id, r.FormValue("variant"))
+	if err != nil {
+		c.Errorf("revalidateTask(Variant) error: %#v", err)
+		return
+	}
+	k, p, a, err := load(c, id)
+	if err != nil {
+		c.Errorf("revalidateTask(Property) error: %#v", err)
+		return
+	}
+	t := transport(c, a)
+	defer saveToken(c, p.Account, a, t)
+	if _, err := revalidate(c, t, k, p, b, b.Key(c)); err != nil {
+		c.Warningf("revalidateTask(Query) property %s error: %#v", id, err)
+	}
+}
+
+// query fetches a badge's values from the Analytics API, caching them in both
+// memcache and datastore.
+func query(c appengine.Context, t *oauth.Transport, k *datastore.Key, p *Property, b *Badge) (*Value, error) {
+	v, err := live(c, t, p, b)
+	if err != nil {
+		return nil, err
+	}
+	item := &memcache.Item{
+		Key:        b.Key(c),
+		Object:     v,
+		Expiration: v.TTL,
+	}
+	if err := memcache.Gob.Set(cache(c), item); err != nil {
+		c.Errorf("query(Memcache) error: %#v", err)
+	}
+	// Realtime values go stale too quickly to be worth persisting.
+	if b.Realtime {
+		return v, nil
+	}
+	if _, err := datastore.Put(c, datastore.NewKey(c, "Value", b.Variant(), 0, k), v); err != nil {
+		c.Errorf("query(Value write) error: %#v", err)
+	}
+	return v, nil
+}
+
+// live fetches a badge's values from the Analytics API, without caching them.
+func live(c appengine.Context, t *oauth.Transport, p *Property, b *Badge) (*Value, error) {
+	analytics, err := analytics.New(t.Client())
+	if err != nil {
+		c.Errorf("query error: %#v", err)
+		return nil, err
+	}
+	profile, err := p.profile(b)
+	if err != nil {
+		return nil, err
+	}
+	sorted := b.sorted()
+	do := func(window Range) (map[string]string, error) {
+		p.used(c)
+		if ga4(p.Id) {
+			return runReport(t.Client(), p.Id, b, window)
+		}
+		if b.Realtime {
+			result, err := analytics.Data.Realtime.Get("ga:"+profile, strings.Join(sorted, ",")).Do()
+			if err != nil {
+				return nil, err
+			}
+			return result.TotalsForAllResults, nil
+		}
+		call := analytics.Data.Ga.Get("ga:"+profile, window.Start, window.End, strings.Join(sorted, ","))
+		if b.Filters != "" {
+			call = call.Filters(b.Filters)
+		}
+		result, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		return result.TotalsForAllResults, nil
+	}
+	// Trend badges also need the window before, cached alongside.
+	windows := []Range{ranges[b.Range]}
+	if b.Trend {
+		windows = append(windows, ranges[b.Range].previous())
+	}
+	all := func() ([]map[string]string, error) {
+		var results []map[string]string
+		for _, window := range windows {
+			result, err := do(window)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+		}
+		return results, nil
+	}
+	results, err := all()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusUnauthorized {
+		if err := t.Refresh(); err != nil {
+			c.Errorf("query(Refresh) error: %#v", err)
+			return nil, errAuthExpired
+		}
+		results, err = all()
+	}
+	if err != nil {
+		gaErrors.inc()
+	}
+	if rateLimited(err) {
+		c.Warningf("query(Data) rate limited: %#v", err)
+		return nil, errRateLimited
+	}
+	if err != nil {
+		c.Errorf("query(Data) error: %#v", err)
+		return nil, err
+	}
+	var joined []string
+	for _, result := range results {
+		values, err := totals(sorted, result)
+		if err != nil {
+			c.Errorf("query(Total) error: %#v", err)
+			return nil, err
+		}
+		joined = append(joined, values)
+	}
+	v := &Value{
+		Profile:  profile,
+		Cached:   joined[0],
+		CachedAt: time.Now(),
+		TTL:      p.ttl(),
+	}
+	if b.Trend {
+		v.Previous = joined[1]
+	}
+	if b.Realtime {
+		v.TTL = time.Minute
+	}
+	if b.Range == "alltime" && v.TTL < allTimeTTL {
+		v.TTL = allTimeTTL
+	}
+	if err = b.unpack(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// totals joins a window's totals for the sorted metrics into the form Value
+// caches them in, checking each can be formatted.
+func totals(sorted []string, result map[string]string) (string, error) {
+	var values []string
+	for _, m := range sorted {
+		// Windows without any data come back without totals.
+		total := or(result[m], "0")
+		if _, _, err := format(m, total, Thresholds{}); err != nil {
+			return "", err
+		}
+		values = append(values, total)
+	}
+	return strings.Join(values, ","), nil
+}
+
+// order returns values in the order the metrics were requested.
+func (b *Badge) order(values map[string]string) []string {
+	var ordered []string
+	for _, m := range b.Metrics {
+		ordered = append(ordered, values[m])
+	}
+	return ordered
+}
+
+var (
+	errAggregate = errors.New("invalid profiles")
+	errEmbedded  = errors.New("embedded elsewhere")
+	validProfile = regexp.MustCompile(`^\d+$`)
+)
+
+// aggregated is what aggregate caches, keeping the ids of the properties
+// summed so their referer restrictions still apply to cached sums.
+type aggregated struct {
+	Value   Value
+	Members []string
+}
+
+// aggregate sums a badge's counts across several profiles, which must all be
+// configured by the same account, fetching them a few at a time. Each of
+// their properties must allow the request's referer.
+func aggregate(c appengine.Context, w http.ResponseWriter, r *http.Request, b *Badge, list string) (*Value, error) {
+	profiles := strings.Split(list, ",")
+	sort.Strings(profiles)
+	if list == "" || len(profiles) > 20 {
+		return nil, errAggregate
+	}
+	for i, profile := range profiles {
+		if !validProfile.MatchString(profile) || i > 0 && profile == profiles[i-1] {
+			return nil, errAggregate
+		}
+	}
+	for _, m := range b.Metrics {
+		if b.Realtime || metrics[m].Kind != Count {
+			return nil, errAggregate
+		}
+	}
+	embeddable := func(members []string) bool {
+		vary := false
+		for _, id := range members {
+			p := defaults(c, id)
+			if len(p.AllowedReferers) > 0 && !vary {
+				w.Header().Add("Vary", "Referer")
+				vary = true
+			}
+			if !p.embeddable(r) {
+				w.Header().Set("Cache-Control", "no-cache")
+				return false
+			}
+		}
+		return true
+	}
+	sum := sha1.Sum([]byte(strings.Join(profiles, ",") + ":" + b.Variant()))
+	key := "agg:" + hex.EncodeToString(sum[:])
+	var cached aggregated
+	if _, err := memcache.Gob.Get(cache(c), key, &cached); err == nil {
+		if cached.Value.Values, err = b.parse(cached.Value.Cached); err == nil {
+			if !embeddable(cached.Members) {
+				return nil, errEmbedded
+			}
+			return &cached.Value, nil
+		}
+	}
+	// Several accounts may have badges for a profile, so find the owners who
+	// configured all of them, and settle on the same one every time.
+	owned := make([]map[string]*datastore.Key, len(profiles))
+	for i, profile := range profiles {
+		var properties []Property
+		keys, err := datastore.NewQuery("Property").Filter("Profile =", profile).GetAll(c, &properties)
+		if err != nil {
+			return nil, err
+		}
+		if len(properties) == 0 {
+			return nil, errNotFound
+		}
+		owned[i] = make(map[string]*datastore.Key)
+		for j, p := range properties {
+			owned[i][p.Account.Encode()] = keys[j]
+		}
+	}
+	var owners []string
+	for owner := range owned[0] {
+		shared := true
+		for _, keys := range owned[1:] {
+			if _, ok := keys[owner]; !ok {
+				shared = false
+			}
+		}
+		if shared {
+			owners = append(owners, owner)
+		}
+	}
+	if len(owners) == 0 {
+		return nil, errAggregate
+	}
+	sort.Strings(owners)
+	var badges []*Badge
+	var members []string
+	for _, keys := range owned {
+		members = append(members, keys[owners[0]].StringID())
+		badges = append(badges, &Badge{
+			Id:      keys[owners[0]].StringID(),
+			Metrics: b.Metrics,
+			Range:   b.Range,
+		})
+	}
+	if !embeddable(members) {
+		return nil, errEmbedded
+	}
+	values := make([]*Value, len(badges))
+	errs := make([]error, len(badges))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				values[i], errs[i] = fetch(c, badges[i])
+			}
+		}()
+	}
+	for i := range badges {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	sums := make([]int, len(b.Metrics))
+	v := &Value{CachedAt: time.Now(), TTL: 24 * time.Hour}
+	for i := range badges {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		for j, raw := range values[i].Values {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return nil, err
+			}
+			sums[j] += n
+		}
+		if values[i].TTL < v.TTL {
+			v.TTL = values[i].TTL
+		}
+	}
+	for _, sum := range sums {
+		v.Values = append(v.Values, strconv.Itoa(sum))
+	}
+	sorted := make(map[string]string)
+	for i, m := range b.Metrics {
+		sorted[m] = v.Values[i]
+	}
+	var joined []string
+	for _, m := range b.sorted() {
+		joined = append(joined, sorted[m])
+	}
+	v.Cached = strings.Join(joined, ",")
+	item := &memcache.Item{
+		Key:        key,
+		Object:     &aggregated{*v, members},
+		Expiration: v.TTL,
+	}
+	if err := memcache.Gob.Set(cache(c), item); err != nil {
+		c.Errorf("aggregate(Memcache) error: %#v", err)
+	}
+	return v, nil
+}
+
+// Badge ids are the Property's key name: a property id, after the owner's
+// hash for properties saved since keys were scoped to their account.
+var validId = regexp.MustCompile(`^([0-9a-f]{16}/)?[\w-]+$`)
+
+// badgePath extracts the property id from a path made of prefix, the id, and
+// one of the allowed suffixes.
+func badgePath(path, prefix string, suffixes ...string) (string, bool) {
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(path, suffix) {
+			return normalizeId(path[len(prefix) : len(path)-len(suffix)])
+		}
+	}
+	return "", false
+}
+
+// validProperty matches Universal Analytics tracking ids, GA4 property
+// numbers and agg, the id aggregate badges are requested with.
+var validProperty = regexp.MustCompile(`^(UA-\d+-\d+|\d+|agg)$`)
+
+// normalizeId tidies up common typos in a badge id, stray spaces and a
+// lowercase ua- prefix, then reports whether it has a property id's shape.
+// Invalid ids are still returned, so they can be named in the error.
+func normalizeId(id string) (string, bool) {
+	owner, property := "", strings.TrimSpace(id)
+	if i := strings.LastIndex(property, "/"); i >= 0 {
+		owner, property = strings.ToLower(strings.TrimSpace(property[:i]))+"/", strings.TrimSpace(property[i+1:])
+	}
+	if strings.HasPrefix(strings.ToUpper(property), "UA-") {
+		property = "UA-" + property[3:]
+	}
+	id = owner + property
+	return id, validId.MatchString(id) && validProperty.MatchString(property)
+}
+
+func badge(w http.ResponseWriter, r *http.Request) {
+	id, ok := badgePath(r.URL.Path, "/badge/", ".svg", ".png")
+	if !ok && id != "" {
+		errorBadge(w, r, http.StatusBadRequest, "invalid property id")
+		return
+	}
+	if !ok {
+		errorBadge(w, r, http.StatusNotFound, "unknown badge")
+		return
+	}
+	if r.FormValue("top") != "" {
+		render(w, r, lookupTop(w, r, id))
+		return
+	}
+	render(w, r, lookup(w, r, id))
+}
+
+// embed serves a badge as a small HTML page with the SVG inline, for sites
+// which strip SVG images but allow iframes.
+func embed(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	look := errorParams(http.StatusNotFound, "unknown badge")
+	if id, ok := badgePath(r.URL.Path, "/embed/", ".html"); ok {
+		look = lookup(w, r, id)
+	}
+	key := "embed:" + look.hash()
+	var body []byte
+	if item, err := memcache.Get(cache(c), key); err == nil {
+		body = item.Value
+	} else {
+		var image, page bytes.Buffer
+		if err := svg(&image, look); err != nil {
+			c.Errorf("embed(SVG) error: %#v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := templates.ExecuteTemplate(&page, "embed.html", template.HTML(image.String())); err != nil {
+			c.Errorf("embed(HTML) error: %#v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = page.Bytes()
+		item := &memcache.Item{
+			Key:        key,
+			Value:      body,
+			Expiration: time.Hour * 12,
+		}
+		if err := memcache.Set(cache(c), item); err != nil {
+			c.Errorf("embed(Memcache) error: %#v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Any site may frame the page, but it can't load or run anything itself.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; frame-ancestors *")
+	cacheFor(w, look.Status)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if look.Status != 0 {
+		w.WriteHeader(look.Status)
+	}
+	w.Write(body)
+}
+
+// lookup parses a badge request and fetches its values, returning how the
+// badge should look. Cache-Control is set on w when the values dictate it.
+func lookup(w http.ResponseWriter, r *http.Request, id string) BadgeParams {
+	c := appengine.NewContext(r)
+	badgeRequests.inc()
+	p := defaults(c, id)
+	if r.FormValue("lang") == "" {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	if !p.embeddableHere(w, r) {
+		return errorParams(http.StatusForbidden, "embedded elsewhere")
+	}
+	b, err := parseBadge(r, id, p)
+	if err != nil {
+		return errorParams(http.StatusBadRequest, err.Error())
+	}
+	look := appearance(r)
+	look.Left = b.Label
+	var v *Value
+	if id == "agg" {
+		v, err = aggregate(c, w, r, b, r.FormValue("profiles"))
+	} else {
+		v, err = fetch(c, b)
+		if err == errNotFound && selfServe && provision(c, r, id) {
+			v, err = fetch(c, b)
+		}
+	}
+	switch err {
+	case nil:
+	case errAuthExpired:
+		look.Status, look.Right, look.Color = errorStatus(err), err.Error(), "#9f9f9f"
+		return look
+	case errRateLimited:
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Header().Set("Retry-After", "300")
+		look.Status, look.Right, look.Color = errorStatus(err), err.Error(), "#9f9f9f"
+		return look
+	case errUnavailable:
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Retry-After", "60")
+		look.Status, look.Right, look.Color = errorStatus(err), err.Error(), "#9f9f9f"
+		return look
+	case errNotFound:
+		// Likely a typo in the embed, so make it stand out.
+		return errorParams(errorStatus(err), "unknown badge")
+	case errProfile, errAggregate, errGA4Metric, errGA4Filters, errEmbedded:
+		return errorParams(errorStatus(err), err.Error())
+	default:
+		return errorParams(errorStatus(err), "error")
+	}
+	maxAge := v.MaxAge()
+	if n := cacheSeconds(r); n > 0 {
+		maxAge = n
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	look.Right, look.Color = b.message(v.Values)
+	look.Title = v.ago()
+	if b.Trend && v.PreviousValues != nil {
+		arrow, color := trend(v.Values[0], v.PreviousValues[0])
+		look.Right += " " + arrow
+		if color != "" && b.Color == "" {
+			look.Color = color
+		}
+	}
+	return look
+}
+
+// trend describes the change in the first metric since the previous window,
+// with a color for its direction. A previous value of zero has no percentage.
+func trend(current, previous string) (string, string) {
+	now, err := strconv.ParseFloat(current, 64)
+	if err != nil {
+		return "", ""
+	}
+	before, err := strconv.ParseFloat(previous, 64)
+	if err != nil {
+		return "", ""
+	}
+	switch {
+	case now == before:
+		return "±0%", ""
+	case before == 0:
+		return "▲", "#4c1"
+	case now > before:
+		return fmt.Sprintf("▲%.0f%%", (now-before)/before*100), "#4c1"
+	}
+	return fmt.Sprintf("▼%.0f%%", (before-now)/before*100), "#e05d44"
+}
+
+// progress formats n as a percentage of target, greener the closer it gets.
+// Going over shows as >100%, since how far over rarely matters.
+func progress(n, target int) (string, string) {
+	percent := n * 100 / target
+	switch {
+	case n > target:
+		return ">100%", "#4c1"
+	case percent == 100:
+		return "100%", "#4c1"
+	case percent >= 80:
+		return strconv.Itoa(percent) + "%", "#97ca00"
+	case percent >= 50:
+		return strconv.Itoa(percent) + "%", "#a4a61d"
+	case percent >= 25:
+		return strconv.Itoa(percent) + "%", "#dfb317"
+	}
+	return strconv.Itoa(percent) + "%", "#e05d44"
+}
+
+// message formats values as the right hand text, colored by the first value.
+// Only counts are per range, so other kinds drop the range suffix.
+func (b *Badge) message(values []string) (string, string) {
+	var numbers []string
+	var color string
+	counts := true
+	for i, raw := range values {
+		m := b.Metrics[i]
+		number, tier, err := format(m, raw, b.Thresholds)
+		if err != nil {
+			number, tier = "?", "#9f9f9f"
+		}
+		if i == 0 {
+			color = tier
+		}
+		if metrics[m].Kind != Count {
+			counts = false
+		}
+		numbers = append(numbers, number)
+	}
+	if b.Target > 0 && len(values) == 1 {
+		if n, err := strconv.Atoi(values[0]); err == nil {
+			numbers[0], color = progress(n, b.Target)
+			counts = false
+		}
+	}
+	if b.Color != "" {
+		color = b.Color
+	}
+	message := strings.Join(numbers, " / ")
+	if b.Realtime {
+		return message + " " + b.translate("online"), color
+	}
+	if b.Suffix != "" && b.SuffixLeft {
+		return b.Suffix + " " + message, color
+	}
+	if b.Suffix != "" {
+		return message + " " + b.Suffix, color
+	}
+	if counts {
+		window, ok := ranges[b.Range]
+		if !ok {
+			window = ranges["7d"]
+		}
+		message += b.translate(window.Suffix)
+	}
+	return message, color
+}
+
+// staticBadge draws a badge straight from its parameters, without analytics.
+func staticBadge(w http.ResponseWriter, r *http.Request) {
+	message := sanitize(r.FormValue("message"))
+	color := parseColor(r.FormValue("color"))
+	if color == "" {
+		color = "#9f9f9f"
+		if n, err := strconv.Atoi(message); err == nil {
+			message, color = metric(n, defaultThresholds)
+		}
+	}
+	look := appearance(r)
+	look.Left, look.Right, look.Color = sanitize(r.FormValue("label")), message, color
+	render(w, r, look)
+}
+
+func data(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	w.Header().Set("Content-Type", "application/json")
+	shields := r.FormValue("shields") != ""
+	id, ok := badgePath(r.URL.Path, "/data/", ".json", "")
+	p := defaults(c, id)
+	if r.FormValue("lang") == "" {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	b, err := parseBadge(r, id, p)
+	if !ok && id != "" {
+		b, err = nil, errors.New("invalid property id")
+	} else if !ok {
+		b, err = nil, errors.New("invalid path")
+	}
+	var v *Value
+	status := http.StatusBadRequest
+	if err == nil && !p.embeddableHere(w, r) {
+		err, status = errors.New("embedded elsewhere"), http.StatusForbidden
+	}
+	if err == nil {
+		v, err = fetch(c, b)
+		status = errorStatus(err)
+	}
+	var body interface{}
+	if shields {
+		response := map[string]interface{}{
+			"schemaVersion": 1,
+		}
+		if b != nil {
+			response["label"] = b.Label
+		}
+		if err != nil {
+			response["message"] = err.Error()
+			response["color"] = "lightgrey"
+			response["isError"] = true
+		} else {
+			message, color := b.message(v.Values)
+			response["message"] = message
+			response["color"] = strings.TrimPrefix(color, "#")
+			if n := cacheSeconds(r); n > 0 {
+				response["cacheSeconds"] = n
+			}
+		}
+		body = response
+	} else if err != nil {
+		w.WriteHeader(status)
+		body = map[string]string{"error": err.Error()}
+	} else {
+		var numbers []float64
+		for _, raw := range v.Values {
+			f, _ := strconv.ParseFloat(raw, 64)
+			numbers = append(numbers, f)
+		}
+		response := map[string]interface{}{
+			"label": b.Label,
+			"value": numbers[0],
+			"range": b.Range,
+		}
+		if len(numbers) > 1 {
+			response["values"] = numbers
+		}
+		body = response
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		c.Errorf("data(Encode) error: %#v", err)
+	}
 }
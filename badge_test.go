@@ -0,0 +1,154 @@
+package analyticsbadge
+
+import (
+	"bytes"
+	"code.google.com/p/google-api-go-client/analytics/v3"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 10},
+		{" ", 14},
+		{"1", 17},
+		{"users", 40},
+		{"中", 21},
+		{"é", 17},
+		{"e\u0301", 17},
+	}
+	for _, test := range tests {
+		if got := size(test.s); got != test.want {
+			t.Errorf("size(%q) = %d, want %d", test.s, got, test.want)
+		}
+	}
+}
+
+func TestMetric(t *testing.T) {
+	tests := []struct {
+		i          int
+		thresholds Thresholds
+		number     string
+		color      string
+	}{
+		{0, Thresholds{}, "0", "#e05d44"},
+		{1000, Thresholds{}, "1.0k", "#e05d44"},
+		{1001, Thresholds{}, "1.0k", "#a4a61d"},
+		{1000000, Thresholds{}, "1.0M", "#a4a61d"},
+		{1000001, Thresholds{}, "1.0M", "#4c1"},
+		{10, Thresholds{Yellow: 10, Green: 100}, "10", "#e05d44"},
+		{11, Thresholds{Yellow: 10, Green: 100}, "11", "#a4a61d"},
+		{101, Thresholds{Yellow: 10, Green: 100}, "101", "#4c1"},
+		{5, Thresholds{Yellow: 100, Green: 10, Invert: true}, "5", "#4c1"},
+		{50, Thresholds{Yellow: 100, Green: 10, Invert: true}, "50", "#a4a61d"},
+		{100, Thresholds{Yellow: 100, Green: 10, Invert: true}, "100", "#e05d44"},
+	}
+	for _, test := range tests {
+		number, color := metric(test.i, test.thresholds)
+		if number != test.number || color != test.color {
+			t.Errorf("metric(%d, %+v) = %q, %q, want %q, %q", test.i, test.thresholds, number, color, test.number, test.color)
+		}
+	}
+}
+
+// TestRenderGolden compares a rendered badge with testdata/badge.svg. Run with
+// -update after an intended change to the badge templates.
+func TestRenderGolden(t *testing.T) {
+	got, err := RenderBadge("users", "1.2k/week", "brightgreen")
+	if err != nil {
+		t.Fatalf("RenderBadge error: %v", err)
+	}
+	golden := filepath.Join("testdata", "badge.svg")
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("RenderBadge output differs from %s:\n%s", golden, got)
+	}
+}
+
+func TestHumanize(t *testing.T) {
+	tests := []struct {
+		i    int
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1000, "1.0k"},
+		{1049, "1.0k"},
+		{1050, "1.1k"},
+		{9949, "9.9k"},
+		{9950, "10k"},
+		{999499, "999k"},
+		{999500, "1.0M"},
+		{999999, "1.0M"},
+		{1000000, "1.0M"},
+		{123456789, "123M"},
+	}
+	for _, test := range tests {
+		if got := humanize(test.i); got != test.want {
+			t.Errorf("humanize(%d) = %q, want %q", test.i, got, test.want)
+		}
+	}
+}
+
+func TestAccountEqual(t *testing.T) {
+	now := time.Now()
+	a := Account{Username: "someone@example.com", AccessToken: "access", RefreshToken: "refresh", Expiry: now}
+	same := func(expiry time.Time) Account {
+		b := a
+		b.Expiry = expiry
+		return b
+	}
+	tests := []struct {
+		name string
+		b    Account
+		want bool
+	}{
+		{"identical", a, true},
+		{"no monotonic clock", same(now.Round(0)), true},
+		{"other location", same(now.In(time.FixedZone("UTC+5", 5*60*60))), true},
+		{"later expiry", same(now.Add(time.Second)), false},
+		{"other token", Account{Username: a.Username, AccessToken: "other", RefreshToken: a.RefreshToken, Expiry: now}, false},
+	}
+	for _, test := range tests {
+		if got := a.Equal(test.b); got != test.want {
+			t.Errorf("%s: Equal = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTotals(t *testing.T) {
+	sorted := []string{"ga:sessions", "ga:users"}
+	tests := []struct {
+		name   string
+		result *analytics.GaData
+		want   string
+		err    bool
+	}{
+		{"empty", &analytics.GaData{}, "0,0", false},
+		{"partial", &analytics.GaData{TotalsForAllResults: map[string]string{"ga:users": "12"}}, "0,12", false},
+		{"full", &analytics.GaData{TotalsForAllResults: map[string]string{"ga:sessions": "34", "ga:users": "12"}}, "34,12", false},
+		{"malformed", &analytics.GaData{TotalsForAllResults: map[string]string{"ga:users": "lots"}}, "", true},
+	}
+	for _, test := range tests {
+		got, err := totals(sorted, test.result.TotalsForAllResults)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("%s: totals = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package analyticsbadge
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// tokenKey encrypts the OAuth tokens saved with each Account, when the
+// TOKEN_KEY environment variable holds a base64 AES key.
+var tokenKey cipher.AEAD
+
+// sealed marks encrypted tokens, so plaintext ones saved before the key was
+// configured can still be read, and are upgraded when next written.
+const sealed = "enc:"
+
+var errNoTokenKey = errors.New("token is encrypted but TOKEN_KEY is not set")
+
+func parseTokenKey(s string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("TOKEN_KEY must be 16, 24 or 32 bytes: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a token for storage, if there's a key to encrypt it with.
+func seal(token string) string {
+	if tokenKey == nil || token == "" || strings.HasPrefix(token, sealed) {
+		return token
+	}
+	nonce := make([]byte, tokenKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		// Without randomness GCM isn't safe, and a lost token only means
+		// signing in again.
+		return ""
+	}
+	return sealed + base64.StdEncoding.EncodeToString(tokenKey.Seal(nonce, nonce, []byte(token), nil))
+}
+
+// unseal returns a stored token in plaintext.
+func unseal(stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealed) {
+		return stored, nil
+	}
+	if tokenKey == nil {
+		return "", errNoTokenKey
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealed))
+	if err != nil {
+		return "", err
+	}
+	n := tokenKey.NonceSize()
+	if len(data) < n {
+		return "", errors.New("encrypted token too short")
+	}
+	plain, err := tokenKey.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Seal encrypts any tokens saved before TOKEN_KEY was set.
+func (a *Account) Seal() {
+	a.AccessToken = seal(a.AccessToken)
+	a.RefreshToken = seal(a.RefreshToken)
+}
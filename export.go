@@ -0,0 +1,91 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"net/http"
+)
+
+// exportProperties downloads the signed in account's badge settings, in the
+// format accepted by /import and /api/properties.
+func exportProperties(w http.ResponseWriter, r *http.Request, s *Session) error {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Account.Username == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "not signed in"})
+	}
+	c := appengine.NewContext(r)
+	var properties []Property
+	if _, err := datastore.NewQuery("Property").Filter("Account =", s.Key(c)).GetAll(c, &properties); err != nil {
+		return err
+	}
+	requests := []PropertyRequest{}
+	for i := range properties {
+		requests = append(requests, propertyRequest(&properties[i]))
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="analytics-badge.json"`)
+	return json.NewEncoder(w).Encode(requests)
+}
+
+// importProperties saves a POSTed export. Properties whose view the account
+// can no longer see are skipped, and everything else is saved at once.
+func importProperties(w http.ResponseWriter, r *http.Request, s *Session) error {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Account.Username == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "not signed in"})
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "POST required"})
+	}
+	var requests []PropertyRequest
+	if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON: " + err.Error()})
+	}
+	c := appengine.NewContext(r)
+	t := transport(c, &s.Account)
+	if t.Token == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return json.NewEncoder(w).Encode(map[string]string{"error": "sign in again to grant Analytics access"})
+	}
+	_, loaded, names, err := visible(c, t)
+	if s.Account.TokenChanged(t.Token) {
+		s.Account.SetToken(t.Token)
+	}
+	if err != nil {
+		return err
+	}
+	owned, err := ownedKeys(c, s.Key(c))
+	if err != nil {
+		return err
+	}
+	var keys []*datastore.Key
+	var properties []*Property
+	imported, skipped := []string{}, []string{}
+	seen := make(map[string]bool)
+	for i := range requests {
+		req := &requests[i]
+		if seen[req.Id] || !loaded[req.Id][req.Profile] {
+			skipped = append(skipped, req.Id)
+			continue
+		}
+		seen[req.Id] = true
+		k, ok := owned[req.Id]
+		if !ok {
+			k = propertyKey(c, s.Key(c), req.Id)
+		}
+		keys = append(keys, k)
+		properties = append(properties, req.property(s.Key(c), loaded[req.Id], names[req.Id]))
+		imported = append(imported, k.StringID())
+	}
+	if len(keys) > 0 {
+		if _, err := datastore.PutMulti(c, keys, properties); err != nil {
+			return err
+		}
+		invalidate(c, imported...)
+	}
+	return json.NewEncoder(w).Encode(map[string][]string{"imported": imported, "skipped": skipped})
+}
@@ -0,0 +1,174 @@
+package analyticsbadge
+
+import (
+	"bytes"
+	"code.google.com/p/google-api-go-client/analytics/v3"
+	"code.google.com/p/google-api-go-client/googleapi"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type GA4Metric struct {
+	Name  string
+	Scale float64
+}
+
+// Names of the Universal Analytics metrics in the Analytics Data API. GA4
+// reports bounce rate as a fraction, rather than a percentage.
+var ga4Metrics = map[string]GA4Metric{
+	"ga:users":              {"activeUsers", 1},
+	"ga:newUsers":           {"newUsers", 1},
+	"ga:sessions":           {"sessions", 1},
+	"ga:pageviews":          {"screenPageViews", 1},
+	"ga:bounceRate":         {"bounceRate", 100},
+	"ga:avgSessionDuration": {"averageSessionDuration", 1},
+	"rt:activeUsers":        {"activeUsers", 1},
+	"ga:goalCompletionsAll": {"conversions", 1},
+}
+
+var (
+	errGA4Metric  = errors.New("metric not in GA4")
+	errGA4Filters = errors.New("no filters for GA4")
+)
+
+// ga4Start is the earliest date the Data API accepts, used for all time.
+const ga4Start = "2015-08-14"
+
+// ga4 reports whether a property id is a GA4 property, which are numeric
+// where Universal Analytics ones look like UA-1234-1.
+func ga4(id string) bool {
+	return validProfile.MatchString(id)
+}
+
+// runReport queries the Analytics Data API for a GA4 property's totals,
+// keyed by the Universal Analytics metric names the badge was given.
+func runReport(client *http.Client, property string, b *Badge, window Range) (map[string]string, error) {
+	type metric struct {
+		Name string `json:"name"`
+	}
+	if b.Filters != "" {
+		return nil, errGA4Filters
+	}
+	request := map[string]interface{}{}
+	var names []metric
+	for _, m := range b.Metrics {
+		g, ok := ga4Metrics[m]
+		if !ok {
+			return nil, errGA4Metric
+		}
+		names = append(names, metric{g.Name})
+	}
+	request["metrics"] = names
+	method := ":runReport"
+	if b.Realtime {
+		method = ":runRealtimeReport"
+	} else {
+		start := window.Start
+		if start == allTimeStart {
+			start = ga4Start
+		}
+		request["dateRanges"] = []map[string]string{{"startDate": start, "endDate": window.End}}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	u := "https://analyticsdata.googleapis.com/v1beta/properties/" + url.QueryEscape(property) + method
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	var report struct {
+		Rows []struct {
+			MetricValues []struct {
+				Value string
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, err
+	}
+	results := make(map[string]string)
+	for i, m := range b.Metrics {
+		// Reports without any activity have no rows at all.
+		value := "0"
+		if len(report.Rows) > 0 && i < len(report.Rows[0].MetricValues) {
+			value = report.Rows[0].MetricValues[i].Value
+		}
+		if scale := ga4Metrics[m].Scale; scale != 1 {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+			value = strconv.FormatFloat(f*scale, 'f', -1, 64)
+		}
+		results[m] = value
+	}
+	return results, nil
+}
+
+// ga4Summaries lists the GA4 properties visible to the account through the
+// Analytics Admin API, shaped like Universal Analytics summaries so manage
+// can show them alongside. Each property appears as its own single profile.
+func ga4Summaries(client *http.Client) ([]*analytics.AccountSummary, error) {
+	var all []*analytics.AccountSummary
+	token := ""
+	for {
+		u := "https://analyticsadmin.googleapis.com/v1beta/accountSummaries?pageSize=200"
+		if token != "" {
+			u += "&pageToken=" + url.QueryEscape(token)
+		}
+		resp, err := client.Get(u)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			AccountSummaries []struct {
+				Account           string
+				DisplayName       string
+				PropertySummaries []struct {
+					Property    string
+					DisplayName string
+				}
+			}
+			NextPageToken string
+		}
+		err = googleapi.CheckResponse(resp)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range page.AccountSummaries {
+			account := &analytics.AccountSummary{
+				Id:   strings.TrimPrefix(a.Account, "accounts/"),
+				Name: a.DisplayName,
+			}
+			for _, p := range a.PropertySummaries {
+				id := strings.TrimPrefix(p.Property, "properties/")
+				account.WebProperties = append(account.WebProperties, &analytics.WebPropertySummary{
+					Id:       id,
+					Name:     p.DisplayName,
+					Profiles: []*analytics.ProfileSummary{{Id: id, Name: "All data"}},
+				})
+			}
+			if len(account.WebProperties) > 0 {
+				all = append(all, account)
+			}
+		}
+		if page.NextPageToken == "" {
+			return all, nil
+		}
+		token = page.NextPageToken
+	}
+}
@@ -0,0 +1,70 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type HeroParams struct {
+	Color  string
+	Number string
+	Label  string
+	Width  int
+	Center int
+}
+
+// heroSize is the size of the number in hero badges, against the 11px size()
+// measures in.
+const heroSize = 28
+
+// hero draws a large badge for landing pages, with the number above its label.
+func hero(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	look := errorParams(http.StatusNotFound, "unknown badge")
+	if id, ok := badgePath(r.URL.Path, "/hero/", ".svg"); ok {
+		look = lookup(w, r, id)
+	}
+	params := HeroParams{
+		Color:  look.Color,
+		Number: look.Right,
+		Label:  look.Left,
+	}
+	// size() pads by 10, which is scaled here along with the text.
+	params.Width = (size(params.Number)-10)*heroSize/11 + 20
+	if label := size(params.Label) + 10; label > params.Width {
+		params.Width = label
+	}
+	params.Center = params.Width / 2
+	key := "hero:" + look.hash()
+	var body []byte
+	if item, err := memcache.Get(cache(c), key); err == nil {
+		body = item.Value
+	} else {
+		var svg bytes.Buffer
+		if err := templates.ExecuteTemplate(&svg, "hero.svg", params); err != nil {
+			c.Errorf("hero error: %#v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = svg.Bytes()
+		item := &memcache.Item{
+			Key:        key,
+			Value:      body,
+			Expiration: time.Hour * 12,
+		}
+		if err := memcache.Set(cache(c), item); err != nil {
+			c.Errorf("hero(Memcache) error: %#v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	cacheFor(w, look.Status)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if look.Status != 0 {
+		w.WriteHeader(look.Status)
+	}
+	w.Write(body)
+}
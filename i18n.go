@@ -0,0 +1,115 @@
+package analyticsbadge
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Translations of the default badge texts, by language, so they can be shown
+// to README readers in their own language. Anything missing stays English.
+var translations = map[string]map[string]string{
+	"de": {
+		"users":        "Nutzer",
+		"new users":    "neue Nutzer",
+		"sessions":     "Sitzungen",
+		"pageviews":    "Seitenaufrufe",
+		"unique views": "eindeutige Aufrufe",
+		"bounce rate":  "Absprungrate",
+		"session":      "Sitzung",
+		"/today":       "/heute",
+		"/day":         "/Tag",
+		"/week":        "/Woche",
+		"/month":       "/Monat",
+		"/quarter":     "/Quartal",
+		"/year":        "/Jahr",
+		" total":       " insgesamt",
+		"online":       "online",
+	},
+	"es": {
+		"users":        "usuarios",
+		"new users":    "usuarios nuevos",
+		"sessions":     "sesiones",
+		"pageviews":    "páginas vistas",
+		"unique views": "vistas únicas",
+		"bounce rate":  "tasa de rebote",
+		"session":      "sesión",
+		"/today":       "/hoy",
+		"/day":         "/día",
+		"/week":        "/semana",
+		"/month":       "/mes",
+		"/quarter":     "/trimestre",
+		"/year":        "/año",
+		" total":       " en total",
+		"online":       "en línea",
+	},
+	"fr": {
+		"users":        "utilisateurs",
+		"new users":    "nouveaux utilisateurs",
+		"sessions":     "sessions",
+		"pageviews":    "pages vues",
+		"unique views": "vues uniques",
+		"bounce rate":  "taux de rebond",
+		"session":      "session",
+		"/today":       "/aujourd'hui",
+		"/day":         "/jour",
+		"/week":        "/semaine",
+		"/month":       "/mois",
+		"/quarter":     "/trimestre",
+		"/year":        "/an",
+		" total":       " au total",
+		"online":       "en ligne",
+	},
+	"pt": {
+		"users":        "usuários",
+		"new users":    "novos usuários",
+		"sessions":     "sessões",
+		"pageviews":    "visualizações",
+		"unique views": "visualizações únicas",
+		"bounce rate":  "taxa de rejeição",
+		"session":      "sessão",
+		"/today":       "/hoje",
+		"/day":         "/dia",
+		"/week":        "/semana",
+		"/month":       "/mês",
+		"/quarter":     "/trimestre",
+		"/year":        "/ano",
+		" total":       " no total",
+		"online":       "online",
+	},
+}
+
+// language picks the translation for a badge from the lang parameter, or
+// failing that the Accept-Language header, returning "" for English.
+func language(r *http.Request) string {
+	if lang := r.FormValue("lang"); lang != "" {
+		lang = primary(lang)
+		if _, ok := translations[lang]; ok {
+			return lang
+		}
+		return ""
+	}
+	// Browsers list languages by preference, so weights are ignored.
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		lang := primary(strings.SplitN(tag, ";", 2)[0])
+		if lang == "en" {
+			return ""
+		}
+		if _, ok := translations[lang]; ok {
+			return lang
+		}
+	}
+	return ""
+}
+
+// primary returns the primary subtag of a language tag, so es-MX is es.
+func primary(tag string) string {
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(tag, "-", 2)[0]))
+}
+
+// translate returns s in the badge's language, if there is a translation.
+func (b *Badge) translate(s string) string {
+	if t, ok := translations[b.Lang][s]; ok {
+		return t
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+package analyticsbadge
+
+import (
+	"bytes"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// renderPNG rasterizes a flat style badge, for clients which can't display SVG.
+func renderPNG(left, right, background string) ([]byte, error) {
+	face := basicfont.Face7x13
+	leftWidth := size(left)
+	if w := font.MeasureString(face, left).Ceil() + 10; w > leftWidth {
+		leftWidth = w
+	}
+	rightWidth := size(right)
+	if w := font.MeasureString(face, right).Ceil() + 10; w > rightWidth {
+		rightWidth = w
+	}
+	img := image.NewRGBA(image.Rect(0, 0, leftWidth+rightWidth, 20))
+	draw.Draw(img, image.Rect(0, 0, leftWidth, 20), image.NewUniform(color.RGBA{0x55, 0x55, 0x55, 0xff}), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(leftWidth, 0, leftWidth+rightWidth, 20), image.NewUniform(rgb(background)), image.ZP, draw.Src)
+	text(img, face, left, leftWidth/2)
+	text(img, face, right, leftWidth+rightWidth/2)
+	round(img, 3)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// text draws s centered on x, with the same drop shadow as the SVG badges.
+func text(img *image.RGBA, face font.Face, s string, x int) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.RGBA{0x01, 0x01, 0x01, 0x4c}),
+		Face: face,
+	}
+	x -= d.MeasureString(s).Round() / 2
+	d.Dot = fixed.P(x, 15)
+	d.DrawString(s)
+	d.Src = image.White
+	d.Dot = fixed.P(x, 14)
+	d.DrawString(s)
+}
+
+// round clears the pixels outside corners of radius r.
+func round(img *image.RGBA, r int) {
+	b := img.Bounds()
+	for y := 0; y < r; y++ {
+		for x := 0; x < r; x++ {
+			dx, dy := float64(r-x)-0.5, float64(r-y)-0.5
+			if dx*dx+dy*dy <= float64(r*r) {
+				continue
+			}
+			img.Set(x, y, color.Transparent)
+			img.Set(b.Max.X-1-x, y, color.Transparent)
+			img.Set(x, b.Max.Y-1-y, color.Transparent)
+			img.Set(b.Max.X-1-x, b.Max.Y-1-y, color.Transparent)
+		}
+	}
+}
+
+// rgb parses a #rgb or #rrggbb color, as produced by metric and parseColor.
+func rgb(s string) color.RGBA {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{0x9f, 0x9f, 0x9f, 0xff}
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
@@ -0,0 +1,124 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"code.google.com/p/google-api-go-client/analytics/v3"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// selfServe lets owners create a badge just by viewing it, rather than
+// visiting /manage first. It's enabled by setting SELF_SERVE.
+var selfServe = os.Getenv("SELF_SERVE") != ""
+
+var errConfigured = errors.New("already configured")
+
+// signedIn returns the account of the request's session, if any, without
+// extending it the way Wrapper does for pages.
+func signedIn(c appengine.Context, r *http.Request) (*datastore.Key, *Account) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return nil, nil
+	}
+	key, err := signingKey(c)
+	if err != nil {
+		c.Errorf("signedIn(Key) error: %#v", err)
+		return nil, nil
+	}
+	id := verify(key, cookie.Value)
+	if id == "" {
+		return nil, nil
+	}
+	item, err := memcache.Get(cache(c), "s:"+id)
+	if err != nil {
+		return nil, nil
+	}
+	ak := datastore.NewKey(c, "Account", string(item.Value), 0, nil)
+	var a Account
+	if err := datastore.Get(c, ak, &a); err != nil {
+		c.Errorf("signedIn(Account) error: %#v", err)
+		return nil, nil
+	}
+	return ak, &a
+}
+
+// provision saves a Property with the default settings for a badge nobody has
+// configured, if the signed in account can see that Analytics property and
+// the badge id is scoped to that account. It reports whether the property was
+// created.
+func provision(c appengine.Context, r *http.Request, id string) bool {
+	ak, a := signedIn(c, r)
+	if a == nil || a.GetToken() == nil {
+		return false
+	}
+	// Only scoped ids are created, and only by the owner they name, so no
+	// account can claim a bare property id for everyone else.
+	i := strings.Index(id, "/")
+	if i < 0 {
+		return false
+	}
+	property := id[i+1:]
+	k := propertyKey(c, ak, property)
+	if k.StringID() != id {
+		return false
+	}
+	t := transport(c, a)
+	defer saveToken(c, ak, a, t)
+	service, err := analytics.New(t.Client())
+	if err != nil {
+		c.Errorf("provision error: %#v", err)
+		return false
+	}
+	accounts, err := summaries(service)
+	if err != nil {
+		c.Errorf("provision(Summaries) error: %#v", err)
+		return false
+	}
+	if ga4(property) {
+		more, err := ga4Summaries(t.Client())
+		if err != nil {
+			c.Errorf("provision(GA4) error: %#v", err)
+			return false
+		}
+		accounts.Items = append(accounts.Items, more...)
+	}
+	var p *Property
+	for _, account := range accounts.Items {
+		for _, wp := range account.WebProperties {
+			if wp.Id == property && len(wp.Profiles) > 0 {
+				p = &Property{
+					Account:     ak,
+					Id:          property,
+					Profile:     wp.Profiles[0].Id,
+					Name:        wp.Name,
+					AccountName: account.Name,
+				}
+			}
+		}
+	}
+	if p == nil {
+		return false
+	}
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var existing Property
+		if err := datastore.Get(c, k, &existing); err != datastore.ErrNoSuchEntity {
+			if err == nil {
+				err = errConfigured
+			}
+			return err
+		}
+		_, err := datastore.Put(c, k, p)
+		return err
+	}, nil)
+	if err != nil {
+		c.Errorf("provision(Property) error: %#v", err)
+		return false
+	}
+	c.Infof("provision: %s created badge %s", a.Username, id)
+	invalidate(c, id)
+	return true
+}
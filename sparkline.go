@@ -0,0 +1,131 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"code.google.com/p/google-api-go-client/analytics/v3"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type SparklineParams struct {
+	Width  int
+	Height int
+	Color  string
+	Points string
+}
+
+var errSparklineGA4 = errors.New("no sparklines for GA4")
+
+// sparkline draws a property's daily counts over the last 30 days as a line.
+func sparkline(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	id, ok := badgePath(r.URL.Path, "/sparkline/", ".svg")
+	if !ok {
+		errorBadge(w, r, http.StatusBadRequest, "invalid path")
+		return
+	}
+	if !defaults(c, id).embeddableHere(w, r) {
+		errorBadge(w, r, http.StatusForbidden, "embedded elsewhere")
+		return
+	}
+	m := or(r.FormValue("metric"), "ga:users")
+	if metrics[m].Label == "" || metrics[m].Kind != Count {
+		errorBadge(w, r, http.StatusBadRequest, "invalid metric")
+		return
+	}
+	counts, err := series(c, id, m)
+	switch err {
+	case nil:
+	case errAuthExpired, errRateLimited, errNotFound, errUnavailable, errSparklineGA4:
+		errorBadge(w, r, errorStatus(err), err.Error())
+		return
+	default:
+		errorBadge(w, r, errorStatus(err), "error")
+		return
+	}
+	params := SparklineParams{
+		Width:  100,
+		Height: 20,
+		Color:  or(parseColor(r.FormValue("color")), "#007ec6"),
+	}
+	params.Points = points(counts, params.Width, params.Height)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if err := respond(w, http.StatusOK, "sparkline.svg", params); err != nil {
+		c.Errorf("sparkline error: %#v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// points scales counts into a polyline filling a width by height viewport,
+// leaving room for the stroke at the top and bottom.
+func points(counts []int, width, height int) string {
+	max := 0
+	for _, n := range counts {
+		if n > max {
+			max = n
+		}
+	}
+	var points []string
+	for i, n := range counts {
+		x := 0.0
+		if len(counts) > 1 {
+			x = float64(i*width) / float64(len(counts)-1)
+		}
+		y := float64(height) - 2
+		if max > 0 {
+			y -= float64(n) / float64(max) * float64(height-4)
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(points, " ")
+}
+
+// series returns a metric's daily totals for the last 30 days, from memcache
+// if possible.
+func series(c appengine.Context, id, metric string) ([]int, error) {
+	key := "spark:" + id + ":" + generation(c, id) + ":" + metric
+	var counts []int
+	if _, err := memcache.Gob.Get(cache(c), key, &counts); err == nil {
+		return counts, nil
+	}
+	_, p, a, err := load(c, id)
+	if err != nil {
+		return nil, err
+	}
+	if p.Profile == "" {
+		return nil, errNotFound
+	}
+	if ga4(p.Id) {
+		return nil, errSparklineGA4
+	}
+	result, err := gaGet(c, key, p, a, func(service *analytics.Service) (*analytics.GaData, error) {
+		return service.Data.Ga.Get("ga:"+p.Profile, "30daysAgo", "yesterday", metric).Dimensions("ga:date").Do()
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range result.Rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("malformed row %q", row)
+		}
+		n, err := strconv.Atoi(row[1])
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, n)
+	}
+	item := &memcache.Item{
+		Key:        key,
+		Object:     counts,
+		Expiration: p.ttl(),
+	}
+	if err := memcache.Gob.Set(cache(c), item); err != nil {
+		c.Errorf("series(Memcache) error: %#v", err)
+	}
+	return counts, nil
+}
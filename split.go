@@ -0,0 +1,139 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"code.google.com/p/google-api-go-client/analytics/v3"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type SplitParams struct {
+	Label          string
+	Text           string
+	Title          string
+	NewColor       string
+	ReturningColor string
+	LabelWidth     int
+	BarWidth       int
+	NewWidth       int
+	Total          int
+	LabelCenter    int
+	TextCenter     int
+}
+
+var errSplitGA4 = errors.New("no user split for GA4")
+
+// split draws the share of new and returning users over a range as a bar.
+func split(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	id, ok := badgePath(r.URL.Path, "/split/", ".svg")
+	if !ok {
+		errorBadge(w, r, http.StatusBadRequest, "invalid path")
+		return
+	}
+	if !defaults(c, id).embeddableHere(w, r) {
+		errorBadge(w, r, http.StatusForbidden, "embedded elsewhere")
+		return
+	}
+	rng := or(r.FormValue("range"), "7d")
+	if _, ok := ranges[rng]; !ok {
+		errorBadge(w, r, http.StatusBadRequest, "invalid range")
+		return
+	}
+	counts, err := userTypes(c, id, rng)
+	switch err {
+	case nil:
+	case errAuthExpired, errRateLimited, errNotFound, errUnavailable, errSplitGA4:
+		errorBadge(w, r, errorStatus(err), err.Error())
+		return
+	default:
+		errorBadge(w, r, errorStatus(err), "error")
+		return
+	}
+	params := SplitParams{
+		Label:          "new / returning",
+		NewColor:       "#007ec6",
+		ReturningColor: "#4c1",
+	}
+	newUsers, returning := counts[0], counts[1]
+	total := newUsers + returning
+	params.Text = "no users"
+	if total > 0 {
+		percent := (newUsers*100 + total/2) / total
+		params.Text = fmt.Sprintf("%d%% / %d%%", percent, 100-percent)
+	} else {
+		params.NewColor, params.ReturningColor = "#9f9f9f", "#9f9f9f"
+	}
+	params.Title = fmt.Sprintf("%s new, %s returning users%s", humanize(newUsers), humanize(returning), ranges[rng].Suffix)
+	params.LabelWidth = size(params.Label)
+	params.BarWidth = size(params.Text)
+	if params.BarWidth < 80 {
+		params.BarWidth = 80
+	}
+	if total > 0 {
+		params.NewWidth = (params.BarWidth*newUsers + total/2) / total
+	}
+	params.Total = params.LabelWidth + params.BarWidth
+	params.LabelCenter = params.LabelWidth/2 + 1
+	params.TextCenter = params.LabelWidth + params.BarWidth/2 - 1
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if err := respond(w, http.StatusOK, "split.svg", params); err != nil {
+		c.Errorf("split error: %#v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// userTypes returns the new and returning users over a range, from memcache
+// if possible.
+func userTypes(c appengine.Context, id, rng string) ([2]int, error) {
+	var counts [2]int
+	key := "split:" + id + ":" + generation(c, id) + ":" + rng
+	if _, err := memcache.Gob.Get(cache(c), key, &counts); err == nil {
+		return counts, nil
+	}
+	_, p, a, err := load(c, id)
+	if err != nil {
+		return counts, err
+	}
+	if p.Profile == "" {
+		return counts, errNotFound
+	}
+	if ga4(p.Id) {
+		return counts, errSplitGA4
+	}
+	window := ranges[rng]
+	result, err := gaGet(c, key, p, a, func(service *analytics.Service) (*analytics.GaData, error) {
+		return service.Data.Ga.Get("ga:"+p.Profile, window.Start, window.End, "ga:users").Dimensions("ga:userType").Do()
+	})
+	if err != nil {
+		return counts, err
+	}
+	for _, row := range result.Rows {
+		if len(row) != 2 {
+			return counts, fmt.Errorf("malformed row %q", row)
+		}
+		n, err := strconv.Atoi(row[1])
+		if err != nil {
+			return counts, err
+		}
+		switch row[0] {
+		case "New Visitor":
+			counts[0] = n
+		case "Returning Visitor":
+			counts[1] = n
+		}
+	}
+	item := &memcache.Item{
+		Key:        key,
+		Object:     counts,
+		Expiration: p.ttl(),
+	}
+	if err := memcache.Gob.Set(cache(c), item); err != nil {
+		c.Errorf("userTypes(Memcache) error: %#v", err)
+	}
+	return counts, nil
+}
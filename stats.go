@@ -0,0 +1,42 @@
+package analyticsbadge
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+type Counter struct {
+	Name  string
+	Help  string
+	count int64
+}
+
+func (c *Counter) inc() {
+	atomic.AddInt64(&c.count, 1)
+}
+
+// Counters for /metrics. They live in memory, so each App Engine instance
+// counts only the requests it served, from when it started.
+var (
+	badgeRequests  = &Counter{Name: "analyticsbadge_badge_requests_total", Help: "Badges looked up."}
+	cacheHits      = &Counter{Name: "analyticsbadge_cache_hits_total", Help: "Badge values found in memcache."}
+	cacheMisses    = &Counter{Name: "analyticsbadge_cache_misses_total", Help: "Badge values not found in memcache."}
+	gaFetches      = &Counter{Name: "analyticsbadge_ga_fetches_total", Help: "Queries made to the Analytics APIs."}
+	gaErrors       = &Counter{Name: "analyticsbadge_ga_errors_total", Help: "Analytics fetches which failed."}
+	manageRequests = &Counter{Name: "analyticsbadge_manage_requests_total", Help: "Manage page requests."}
+	authSuccesses  = &Counter{Name: "analyticsbadge_auth_successes_total", Help: "Completed sign ins."}
+	authFailures   = &Counter{Name: "analyticsbadge_auth_failures_total", Help: "Failed sign ins."}
+	counters       = []*Counter{badgeRequests, cacheHits, cacheMisses, gaFetches, gaErrors, manageRequests, authSuccesses, authFailures}
+)
+
+// stats writes the counters in the Prometheus text format. The values are per
+// instance, so a scraper sees whichever instance answers, and they reset
+// whenever an instance is started.
+func stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.Name, c.Help, c.Name, c.Name, atomic.LoadInt64(&c.count))
+	}
+}
@@ -0,0 +1,57 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"net/http"
+	"time"
+)
+
+// TokenCheck is the outcome of the last scheduled refresh of an account's
+// token, for /admin/stale to report without refreshing tokens itself.
+type TokenCheck struct {
+	Checked time.Time
+	Error   string `datastore:",noindex"`
+}
+
+func tokenCheckKey(c appengine.Context, account *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "TokenCheck", "token", 0, account)
+}
+
+// refreshTokens renews access tokens which expire before the next run, so
+// badge requests rarely wait on a refresh. Accounts whose refresh has been
+// failing for a day are left alone until they sign in again.
+func refreshTokens(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var accounts []Account
+	q := datastore.NewQuery("Account").
+		Filter("Expiry >", time.Now().Add(-24*time.Hour)).
+		Filter("Expiry <", time.Now().Add(15*time.Minute))
+	keys, err := q.GetAll(c, &accounts)
+	if err != nil {
+		c.Errorf("refreshTokens(Account) error: %#v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range accounts {
+		a := &accounts[i]
+		t := transport(c, a)
+		if t.Token == nil || t.Token.RefreshToken == "" {
+			continue
+		}
+		check := &TokenCheck{Checked: time.Now()}
+		if err := t.Refresh(); err != nil {
+			c.Warningf("refreshTokens(Refresh) account %s error: %#v", a.Username, err)
+			check.Error = err.Error()
+		} else {
+			saveToken(c, keys[i], a, t)
+		}
+		if _, err := datastore.Put(c, tokenCheckKey(c, keys[i]), check); err != nil {
+			c.Errorf("refreshTokens(TokenCheck) error: %#v", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package analyticsbadge
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"code.google.com/p/google-api-go-client/analytics/v3"
+	"errors"
+	"net/http"
+)
+
+// Dimensions which can be requested with the top parameter, and their labels.
+var dimensions = map[string]string{
+	"ga:country":         "top country",
+	"ga:city":            "top city",
+	"ga:language":        "top language",
+	"ga:source":          "top source",
+	"ga:socialNetwork":   "top network",
+	"ga:browser":         "top browser",
+	"ga:operatingSystem": "top OS",
+	"ga:deviceCategory":  "top device",
+	"ga:pagePath":        "top page",
+}
+
+var errTopGA4 = errors.New("no top values for GA4")
+
+// lookupTop is lookup for badges naming the value of a dimension with the
+// most of a count metric, like the country most sessions came from.
+func lookupTop(w http.ResponseWriter, r *http.Request, id string) BadgeParams {
+	c := appengine.NewContext(r)
+	badgeRequests.inc()
+	p := defaults(c, id)
+	if !p.embeddableHere(w, r) {
+		return errorParams(http.StatusForbidden, "embedded elsewhere")
+	}
+	dimension := r.FormValue("top")
+	label, ok := dimensions[dimension]
+	if !ok {
+		return errorParams(http.StatusBadRequest, "invalid dimension")
+	}
+	m := or(r.FormValue("metric"), "ga:sessions")
+	if metrics[m].Label == "" || metrics[m].Kind != Count {
+		return errorParams(http.StatusBadRequest, "invalid metric")
+	}
+	rng := or(r.FormValue("range"), or(p.DefaultRange, "7d"))
+	if _, ok := ranges[rng]; !ok {
+		return errorParams(http.StatusBadRequest, "invalid range")
+	}
+	look := appearance(r)
+	look.Left = or(sanitize(r.FormValue("label")), label)
+	value, err := topValue(c, id, dimension, m, rng)
+	switch err {
+	case nil:
+	case errRateLimited:
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Header().Set("Retry-After", "300")
+		look.Status, look.Right, look.Color = errorStatus(err), err.Error(), "#9f9f9f"
+		return look
+	case errNotFound:
+		return errorParams(errorStatus(err), "unknown badge")
+	case errAuthExpired, errUnavailable, errTopGA4:
+		look.Status, look.Right, look.Color = errorStatus(err), err.Error(), "#9f9f9f"
+		return look
+	default:
+		return errorParams(errorStatus(err), "error")
+	}
+	look.Right = or(sanitize(value), "none")
+	look.Color = or(parseColor(r.FormValue("color")), "#007ec6")
+	look.Title = label + " by " + metrics[m].Label + ranges[rng].Suffix
+	return look
+}
+
+// topValue returns the dimension value with the most of metric m over a
+// range, from memcache if possible. It's empty when there was no data.
+func topValue(c appengine.Context, id, dimension, m, rng string) (string, error) {
+	key := "top:" + id + ":" + generation(c, id) + ":" + dimension + ":" + m + ":" + rng
+	if item, err := memcache.Get(cache(c), key); err == nil {
+		return string(item.Value), nil
+	}
+	_, p, a, err := load(c, id)
+	if err != nil {
+		return "", err
+	}
+	if p.Profile == "" {
+		return "", errNotFound
+	}
+	if ga4(p.Id) {
+		return "", errTopGA4
+	}
+	window := ranges[rng]
+	result, err := gaGet(c, key, p, a, func(service *analytics.Service) (*analytics.GaData, error) {
+		return service.Data.Ga.Get("ga:"+p.Profile, window.Start, window.End, m).Dimensions(dimension).Sort("-" + m).MaxResults(1).Do()
+	})
+	if err != nil {
+		return "", err
+	}
+	var value string
+	if len(result.Rows) > 0 && len(result.Rows[0]) > 0 {
+		value = result.Rows[0][0]
+	}
+	item := &memcache.Item{
+		Key:        key,
+		Value:      []byte(value),
+		Expiration: p.ttl(),
+	}
+	if err := memcache.Set(cache(c), item); err != nil {
+		c.Errorf("topValue(Memcache) error: %#v", err)
+	}
+	return value, nil
+}